@@ -7,7 +7,10 @@ package minijinja
 // #include <stdlib.h>
 // #include <minijinja.h>
 import "C"
-import "unsafe"
+import (
+	"strings"
+	"unsafe"
+)
 
 // SyntaxConfig allows one to override the syntax elements.
 type SyntaxConfig struct {
@@ -21,6 +24,39 @@ type SyntaxConfig struct {
 	LineCommentPrefix   string // Line comment prefix.
 }
 
+// defaultSyntax is the default syntax of the engine.
+var defaultSyntax = SyntaxConfig{
+	BlockStart:    "{%",
+	BlockEnd:      "%}",
+	VariableStart: "{{",
+	VariableEnd:   "}}",
+	CommentStart:  "{#",
+	CommentEnd:    "#}",
+}
+
+// block returns a block tag containing stmt.
+func (s *SyntaxConfig) block(stmt string) string {
+	return s.BlockStart + " " + stmt + " " + s.BlockEnd
+}
+
+// variable returns a variable tag containing expr.
+func (s *SyntaxConfig) variable(expr string) string {
+	return s.VariableStart + " " + expr + " " + s.VariableEnd
+}
+
+// endsWithTrim reports whether source ends with a tag whose whitespace
+// control removes the whitespace after it, ignoring that whitespace.
+func (s *SyntaxConfig) endsWithTrim(source string) bool {
+	source = strings.TrimRight(source, " \t\r\n")
+	for _, end := range []string{s.BlockEnd, s.VariableEnd, s.CommentEnd} {
+		if strings.HasSuffix(source, "-"+end) {
+			return true
+		}
+	}
+
+	return false
+}
+
 type cSyntaxConfig struct {
 	ptr *C.mj_syntax_config
 }
@@ -35,18 +35,41 @@ package minijinja
 // #cgo nocallback mj_str_free
 // #cgo LDFLAGS: -L${SRCDIR}/lib -lminijinja_cabi
 // #include <stdlib.h>
+// #include <string.h>
 // #include <minijinja.h>
 import "C"
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
 // Environment represents a MiniJinja environment.
+//
+// An Environment is safe for concurrent use by multiple goroutines. Templates
+// can be rendered and expressions evaluated concurrently, while methods
+// modifying the environment wait for in-flight renders to complete.
 type Environment struct {
-	ptr *C.struct_mj_env
+	// mu guards ptr against modifications during renders, as well as the
+	// fields below it.
+	mu         sync.RWMutex
+	ptr        *C.struct_mj_env
+	globals    map[string]*value
+	loader     Loader
+	jsonTags   bool
+	autoEscape func(name string) AutoEscape
+	syntax     SyntaxConfig
+	// sources holds the sources of the registered templates, to compile
+	// them again when the auto-escaping mode changes.
+	sources map[string]string
+
+	running sync.WaitGroup
 }
 
 // NewEnvironment allocates and returns a new, empty MiniJinja environment.
@@ -55,37 +78,170 @@ func NewEnvironment() *Environment {
 	if env == nil {
 		panic("received nil env")
 	}
+	liveHandles.Add(1)
+
+	e := &Environment{ptr: env, syntax: defaultSyntax}
+	runtime.SetFinalizer(e, (*Environment).Close)
 
-	return &Environment{ptr: env}
+	return e
 }
 
 // Close closes the environment.
+// It waits for renders abandoned by the Context methods to complete.
+//
+// The environment is also closed when it becomes unreachable, but this should
+// not be relied upon.
 func (e *Environment) Close() error {
+	e.running.Wait()
+	runtime.SetFinalizer(e, nil)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if e.ptr != nil {
 		C.mj_env_free(e.ptr)
 		e.ptr = nil
+		liveHandles.Add(-1)
+	}
+	for name, val := range e.globals {
+		_ = val.Close()
+		delete(e.globals, name)
 	}
 	return nil
 }
 
+// AddGlobal registers a global variable with the environment.
+// The value is encoded once and made available to every template and
+// expression. Variables of the same name in the render context take
+// precedence over globals.
+//
+// The C ABI has no way to register globals, so they are merged into the
+// render context. As a consequence, they are not visible inside macros of
+// templates loaded with the import and from tags, which are evaluated without
+// the render context, and renders fail when the context is neither a map, a
+// struct nor nil.
+func (e *Environment) AddGlobal(name string, v any) error {
+	val, err := e.encoder().newValue(v)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.globals == nil {
+		e.globals = make(map[string]*value)
+	}
+	if old, ok := e.globals[name]; ok {
+		_ = old.Close()
+	}
+	e.globals[name] = val
+
+	return nil
+}
+
+// newContext encodes ctx and merges the environment globals into it.
+func (e *Environment) newContext(ctx any) (*value, error) {
+	enc := e.encoder()
+	val, err := enc.newValue(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if len(e.globals) == 0 {
+		return val, nil
+	}
+
+	switch val.kind() {
+	case valueKindNone, valueKindUndefined:
+		_ = val.Close()
+		val = newValueObject()
+	case valueKindMap:
+		if enc.isShared(val) {
+			// Do not modify a value which is shared with other renders.
+			shared := val
+			defer shared.Close()
+			if val, err = shared.copyMap(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		kind := val.kind()
+		_ = val.Close()
+		return nil, &Error{
+			Kind: ErrorKindInvalidOperation,
+			Detail: fmt.Sprintf(
+				"cannot merge globals into a context of kind %s", kind,
+			),
+		}
+	}
+
+	for name, global := range e.globals {
+		existing := val.fieldByName(name)
+		shadowed := existing.kind() != valueKindUndefined
+		_ = existing.Close()
+		if shadowed {
+			continue
+		}
+
+		err := val.setKeyValue(newValueString(name), global.clone())
+		if err != nil {
+			_ = val.Close()
+			return nil, err
+		}
+	}
+
+	return val, nil
+}
+
 // SetDebug enables or disables debug mode.
 func (e *Environment) SetDebug(on bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	C.mj_env_set_debug(e.ptr, C.bool(on))
 }
 
+// SetJSONTags makes the struct fields without a minijinja tag use their json
+// tag, if any, when encoding contexts and decoding expression results.
+func (e *Environment) SetJSONTags(on bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.jsonTags = on
+}
+
+// encoder returns an encoder configured for the environment.
+func (e *Environment) encoder() *encoder {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &encoder{jsonTags: e.jsonTags}
+}
+
+// decoder returns a decoder configured for the environment.
+func (e *Environment) decoder() *decoder {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &decoder{jsonTags: e.jsonTags}
+}
+
 // SetKeepTrailingNewline preserves the trailing newline when rendering
 // templates.
 func (e *Environment) SetKeepTrailingNewline(on bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	C.mj_env_set_keep_trailing_newline(e.ptr, C.bool(on))
 }
 
 // SetLStripBlocks enables or disables the lstrip_blocks feature.
 func (e *Environment) SetLStripBlocks(on bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	C.mj_env_set_lstrip_blocks(e.ptr, C.bool(on))
 }
 
 // SetRecursionLimit changes the recursion limit.
 func (e *Environment) SetRecursionLimit(limit uint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	C.mj_env_set_recursion_limit(e.ptr, C.uint32_t(limit))
 }
 
@@ -94,20 +250,32 @@ func (e *Environment) SetSyntaxConfig(syntax *SyntaxConfig) error {
 	cStx := newCSyntaxConfig(syntax)
 	defer cStx.Close()
 
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 	if !C.mj_env_set_syntax_config(e.ptr, cStx.ptr) {
 		return getError()
 	}
+	e.syntax = *syntax
 
 	return nil
 }
 
 // SetTrimBlocks enables or disables the trim_blocks feature.
 func (e *Environment) SetTrimBlocks(on bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	C.mj_env_set_trim_blocks(e.ptr, C.bool(on))
 }
 
+// syntaxConfig returns the syntax of the environment.
+func (e *Environment) syntaxConfig() SyntaxConfig {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.syntax
+}
+
 // UndefinedBehavior controls the undefined behavior of the engine.
 type UndefinedBehavior int
 
@@ -124,17 +292,157 @@ const (
 
 // SetUndefinedBehavior reconfigures the undefined behavior.
 func (e *Environment) SetUndefinedBehavior(behavior UndefinedBehavior) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	C.mj_env_set_undefined_behavior(
 		e.ptr,
 		C.enum_mj_undefined_behavior(behavior),
 	)
 }
 
+// AutoEscape is an auto-escaping mode.
+type AutoEscape int
+
+const (
+	// AutoEscapeDefault lets the engine decide based on the template name:
+	// templates ending with .html, .htm or .xml are escaped for HTML.
+	AutoEscapeDefault AutoEscape = iota
+	// AutoEscapeNone disables auto-escaping.
+	AutoEscapeNone
+	// AutoEscapeHTML escapes values for HTML and XML.
+	AutoEscapeHTML
+)
+
+// SetAutoEscape sets the auto-escaping mode of all templates.
+// It is a shorthand for [Environment.SetAutoEscapeCallback] with a callback
+// returning mode.
+func (e *Environment) SetAutoEscape(mode AutoEscape) error {
+	return e.SetAutoEscapeCallback(func(string) AutoEscape { return mode })
+}
+
+// SetAutoEscapeCallback sets a callback returning the auto-escaping mode of a
+// template given its name. A nil callback restores the default behavior.
+//
+// The C ABI cannot set the auto-escaping mode, so template sources are
+// wrapped in an autoescape block instead. The templates registered with
+// [Environment.AddTemplate] are compiled again with the new mode. If one of
+// them fails to compile, an error is returned and the previous callback is
+// restored for all templates. The callback is called
+// while the environment is locked, so it must not call its methods.
+//
+// The output of the |safe filter is never escaped. Blocks from a parent
+// template are escaped according to the mode of the parent template. The
+// mode of a template whose first line is a line statement or a line comment
+// cannot be set: such templates fail to compile, unless the callback returns
+// [AutoEscapeDefault] for them.
+func (e *Environment) SetAutoEscapeCallback(
+	cb func(name string) AutoEscape,
+) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	prev := e.autoEscape
+	e.autoEscape = cb
+
+	compiled := make([]string, 0, len(e.sources))
+	for name, source := range e.sources {
+		if err := e.addTemplate(name, source); err != nil {
+			// Compile the templates again with the previous callback, so
+			// that none of them is escaped with the new mode.
+			e.autoEscape = prev
+			for _, name := range compiled {
+				_ = e.addTemplate(name, e.sources[name])
+			}
+			return err
+		}
+		compiled = append(compiled, name)
+	}
+
+	return nil
+}
+
+// withAutoEscape wraps a template source in an autoescape block according to
+// the auto-escaping mode of the template. e.mu must be held.
+func (e *Environment) withAutoEscape(name, source string) (string, error) {
+	if e.autoEscape == nil {
+		return source, nil
+	}
+
+	var mode string
+	switch e.autoEscape(name) {
+	case AutoEscapeNone:
+		mode = "false"
+	case AutoEscapeHTML:
+		mode = "true"
+	case AutoEscapeDefault:
+	}
+	if mode == "" {
+		return source, nil
+	}
+
+	// The opening tag is put on the first line, where a line statement or a
+	// line comment would no longer be at the start of the line.
+	firstLine, _, _ := strings.Cut(source, "\n")
+	firstLine = strings.TrimLeft(firstLine, " \t")
+	for _, prefix := range []string{
+		e.syntax.LineStatementPrefix, e.syntax.LineCommentPrefix,
+	} {
+		if prefix != "" && strings.HasPrefix(firstLine, prefix) {
+			return "", &Error{
+				Kind: ErrorKindInvalidOperation,
+				Detail: fmt.Sprintf(
+					"cannot set the auto-escaping mode of template %q "+
+						"starting with a line statement or comment",
+					name,
+				),
+			}
+		}
+	}
+
+	// The empty expressions keep the trim_blocks and lstrip_blocks options
+	// from removing whitespace of the source around the tags, and the
+	// trailing newline stays last for the keep_trailing_newline option,
+	// unless the whitespace control of the last tag removes it.
+	empty := e.syntax.variable("''")
+	body, newline := source, ""
+	if !e.syntax.endsWithTrim(source) {
+		if b, ok := strings.CutSuffix(source, "\n"); ok {
+			body, newline = b, "\n"
+			if b, ok := strings.CutSuffix(body, "\r"); ok {
+				body, newline = b, "\r\n"
+			}
+		}
+	}
+
+	return e.syntax.block("autoescape "+mode) + empty + body + empty +
+		e.syntax.block("endautoescape") + empty + newline, nil
+}
+
 // AddTemplate registers a template with the environment.
 func (e *Environment) AddTemplate(name, source string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.addTemplate(name, source); err != nil {
+		return err
+	}
+
+	if e.sources == nil {
+		e.sources = make(map[string]string)
+	}
+	e.sources[name] = source
+
+	return nil
+}
+
+// addTemplate compiles a template with the auto-escaping mode of the
+// environment. e.mu must be held for writing.
+func (e *Environment) addTemplate(name, source string) error {
 	cName := C.CString(name)
 	defer C.free(unsafe.Pointer(cName))
-	cSource := C.CString(source)
+	wrapped, err := e.withAutoEscape(name, source)
+	if err != nil {
+		return err
+	}
+	cSource := C.CString(wrapped)
 	defer C.free(unsafe.Pointer(cSource))
 
 	runtime.LockOSThread()
@@ -151,22 +459,28 @@ func (e *Environment) RemoveTemplate(name string) error {
 	cName := C.CString(name)
 	defer C.free(unsafe.Pointer(cName))
 
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 	if ok := C.mj_env_remove_template(e.ptr, cName); !ok {
 		return getError()
 	}
+	delete(e.sources, name)
 
 	return nil
 }
 
 // ClearTemplates clears all templates.
 func (e *Environment) ClearTemplates() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 	if ok := C.mj_env_clear_templates(e.ptr); !ok {
 		return getError()
 	}
+	clear(e.sources)
 
 	return nil
 }
@@ -175,74 +489,305 @@ func (e *Environment) ClearTemplates() error {
 func (e *Environment) RenderNamedString(
 	name, source string, ctx any,
 ) (string, error) {
-	val, err := newValue(ctx)
+	out, err := e.renderNamedString(name, source, ctx)
 	if err != nil {
 		return "", err
 	}
+	defer C.mj_str_free(out)
+
+	return C.GoString(out), nil
+}
+
+// RenderNamedStringTo renders a template from a named string and writes the
+// output to w. See [Environment.RenderTemplateTo].
+func (e *Environment) RenderNamedStringTo(
+	w io.Writer, name, source string, ctx any,
+) error {
+	out, err := e.renderNamedString(name, source, ctx)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(w, out)
+}
+
+// renderNamedString renders a template from a named string.
+// The returned string must be freed with mj_str_free.
+func (e *Environment) renderNamedString(
+	name, source string, ctx any,
+) (*C.char, error) {
+	val, err := e.newContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer val.Close()
 
 	cName := C.CString(name)
 	defer C.free(unsafe.Pointer(cName))
 
-	cSrc := C.CString(source)
-	defer C.free(unsafe.Pointer(cSrc))
+	var out *C.char
+	err = e.withLoader(func() error {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+
+		wrapped, err := e.withAutoEscape(name, source)
+		if err != nil {
+			return err
+		}
+		cSrc := C.CString(wrapped)
+		defer C.free(unsafe.Pointer(cSrc))
+
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		out = C.mj_env_render_named_str(e.ptr, cName, cSrc, val.cVal)
+		if out == nil {
+			return getError()
+		}
+
+		return nil
+	})
+
+	return out, err
+}
 
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	out := C.mj_env_render_named_str(e.ptr, cName, cSrc, val.cVal)
-	if out == nil {
-		return "", getError()
+// RenderTemplate renders a registered template using the provided context.
+func (e *Environment) RenderTemplate(name string, ctx any) (string, error) {
+	out, err := e.renderTemplate(name, ctx)
+	if err != nil {
+		return "", err
 	}
 	defer C.mj_str_free(out)
 
 	return C.GoString(out), nil
 }
 
-// RenderTemplate renders a registered template using the provided context.
-func (e *Environment) RenderTemplate(name string, ctx any) (string, error) {
-	val, err := newValue(ctx)
+// RenderTemplateTo renders a registered template using the provided context
+// and writes the output to w.
+//
+// The output is written directly from the memory of the engine, without being
+// copied into a Go string first, but it is not streamed: the engine renders
+// the whole output before it is written. A failed write is reported as an
+// [Error] of kind [ErrorKindWriteFailure].
+func (e *Environment) RenderTemplateTo(
+	w io.Writer, name string, ctx any,
+) error {
+	out, err := e.renderTemplate(name, ctx)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	return writeOutput(w, out)
+}
+
+// renderTemplate renders a registered template using the provided context.
+// The returned string must be freed with mj_str_free.
+func (e *Environment) renderTemplate(name string, ctx any) (*C.char, error) {
+	val, err := e.newContext(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer val.Close()
 
 	cName := C.CString(name)
 	defer C.free(unsafe.Pointer(cName))
 
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	out := C.mj_env_render_template(e.ptr, cName, val.cVal)
-	if out == nil {
-		return "", getError()
-	}
+	var out *C.char
+	err = e.withLoader(func() error {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		out = C.mj_env_render_template(e.ptr, cName, val.cVal)
+		if out == nil {
+			return getError()
+		}
+
+		return nil
+	})
+
+	return out, err
+}
+
+// writeOutput writes a rendered output to w and frees it.
+func writeOutput(w io.Writer, out *C.char) error {
 	defer C.mj_str_free(out)
 
-	return C.GoString(out), nil
+	b := unsafe.Slice((*byte)(unsafe.Pointer(out)), C.strlen(out))
+	if _, err := w.Write(b); err != nil {
+		return &Error{
+			Kind:   ErrorKindWriteFailure,
+			Detail: err.Error(),
+			err:    err,
+		}
+	}
+
+	return nil
 }
 
 // EvalExpr evaluates an expression string in the given context.
 // It stores the result in the value pointed by data or returns an error if the
 // evaluation fails.
+//
+// Numbers are decoded into interfaces as float64, except integers which a
+// float64 cannot represent exactly, which are decoded as int64, uint64 or
+// [*big.Int].
 func (e *Environment) EvalExpr(expr string, ctx, data any) error {
+	return e.EvalExprWithOptions(expr, ctx, data, EvalExprOptions{})
+}
+
+// EvalExprOptions configures the decoding of the result of an expression.
+// Values rejected by a strict option fail with a [StrictDecodeError].
+type EvalExprOptions struct {
+	// DisallowUnknownFields rejects the keys of a map which do not match any
+	// field of the struct it is decoded into.
+	DisallowUnknownFields bool
+	// RequireAllFields rejects a map which lacks a key for a field of the
+	// struct it is decoded into. Fields with the omitempty option are
+	// optional.
+	RequireAllFields bool
+	// ErrorOnUndefined rejects undefined values instead of leaving the
+	// target untouched.
+	ErrorOnUndefined bool
+	// SafeStrings decodes safe strings as [SafeString] into interfaces,
+	// except map keys. Each such string costs an evaluation by the engine,
+	// since the C ABI cannot tell safe strings apart.
+	SafeStrings bool
+}
+
+// EvalExprWithOptions is like [Environment.EvalExpr], but decodes the result
+// according to opts.
+func (e *Environment) EvalExprWithOptions(
+	expr string, ctx, data any, opts EvalExprOptions,
+) error {
 	rv := reflect.ValueOf(data)
 	if rv.Kind() != reflect.Pointer || rv.IsNil() {
 		return &InvalidEvalExprError{Type: reflect.TypeOf(data)}
 	}
 
-	val, err := newValue(ctx)
+	res, err := e.evalExpr(expr, ctx)
 	if err != nil {
 		return err
 	}
+	defer res.Close()
+
+	d := e.decoder()
+	d.opts = opts
+
+	return d.decode(res, rv.Elem())
+}
+
+// EvalExprContext is like [Environment.EvalExpr], but returns early with an
+// error wrapping ctx.Err() if ctx is done before the evaluation completes.
+//
+// The engine cannot be interrupted, so cancelling ctx does not stop the
+// evaluation: it keeps running in the background on a locked OS thread and
+// holds the read lock of the environment until it completes. Until then,
+// methods modifying the environment block, including the registration of
+// templates requested from the loader, as do the renders queued behind
+// them and [Environment.Close].
+func (e *Environment) EvalExprContext(
+	ctx context.Context, expr string, vars, data any,
+) error {
+	rv := reflect.ValueOf(data)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidEvalExprError{Type: reflect.TypeOf(data)}
+	}
+
+	res, err := runContext(ctx, e, func() (*value, error) {
+		return e.evalExpr(expr, vars)
+	}, func(res *value) { _ = res.Close() })
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return e.decoder().decode(res, rv.Elem())
+}
+
+// evalExpr evaluates an expression string in the given context.
+func (e *Environment) evalExpr(expr string, ctx any) (*value, error) {
+	val, err := e.newContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer val.Close()
 
 	cExpr := C.CString(expr)
 	defer C.free(unsafe.Pointer(cExpr))
 
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 	cRes := C.mj_env_eval_expr(e.ptr, cExpr, val.cVal)
 	if isErrorSet() {
-		return getError()
+		return nil, getError()
 	}
-	runtime.UnlockOSThread()
 
-	res := &value{cVal: cRes}
-	defer res.Close()
-	return res.decode(rv.Elem())
+	return wrapValue(cRes), nil
+}
+
+// RenderTemplateContext is like [Environment.RenderTemplate], but returns
+// early with an error wrapping ctx.Err() if ctx is done before the rendering
+// completes.
+//
+// The engine cannot be interrupted, so cancelling ctx does not stop the
+// render: it keeps running in the background on a locked OS thread and holds
+// the read lock of the environment until the template completes. Until then,
+// methods modifying the environment block, including the registration of
+// templates requested from the loader, as do the renders queued behind them
+// and [Environment.Close]. Render untrusted templates in a separate process
+// if they must be bounded.
+func (e *Environment) RenderTemplateContext(
+	ctx context.Context, name string, data any,
+) (string, error) {
+	return runContext(ctx, e, func() (string, error) {
+		return e.RenderTemplate(name, data)
+	}, nil)
+}
+
+// contextResult holds the result of a function run by [runContext].
+type contextResult[T any] struct {
+	val T
+	err error
+}
+
+// runContext runs fn and returns its result, or returns early with an error
+// wrapping ctx.Err() if ctx is done first.
+//
+// The engine cannot be interrupted, so fn keeps running in the background
+// after an early return: its result is then passed to release, if not nil,
+// and [Environment.Close] waits for it to complete.
+func runContext[T any](
+	ctx context.Context,
+	e *Environment,
+	fn func() (T, error),
+	release func(T),
+) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, fmt.Errorf("minijinja: %w", err)
+	}
+
+	done := make(chan contextResult[T], 1)
+	e.running.Add(1)
+	go func() {
+		defer e.running.Done()
+		val, err := fn()
+		done <- contextResult[T]{val: val, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.val, res.err
+	case <-ctx.Done():
+		if release != nil {
+			go func() {
+				if res := <-done; res.err == nil {
+					release(res.val)
+				}
+			}()
+		}
+		return zero, fmt.Errorf("minijinja: %w", ctx.Err())
+	}
 }
@@ -1,9 +1,14 @@
 package minijinja_test
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/maxbrunet/minijinja-go/v2"
 )
@@ -20,6 +25,237 @@ func TestEnvironment_AddTemplateError(t *testing.T) {
 	isTrue(t, errors.As(err, &mjErr))
 }
 
+func TestEnvironment_AddGlobal(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	err := env.AddGlobal("site", map[string]string{"name": "Go"})
+	isEqual(t, nil, err)
+	err = env.AddGlobal("x", 1)
+	isEqual(t, nil, err)
+
+	src := "{{ site.name }} {{ x }}"
+	s, err := env.RenderNamedString("hello", src, nil)
+	isEqual(t, nil, err)
+	isEqual(t, "Go 1", s)
+
+	s, err = env.RenderNamedString("hello", src, map[string]int{"x": 2})
+	isEqual(t, nil, err)
+	isEqual(t, "Go 2", s)
+
+	var res int
+	err = env.EvalExpr("x + 1", nil, &res)
+	isEqual(t, nil, err)
+	isEqual(t, 2, res)
+
+	_, err = env.RenderNamedString("hello", src, []int{1})
+	var mjErr *minijinja.Error
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, minijinja.ErrorKindInvalidOperation, mjErr.Kind)
+}
+
+func TestEnvironment_SetAutoEscape(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	ctx := map[string]any{"x": "<b>"}
+
+	noError(t, env.SetAutoEscape(minijinja.AutoEscapeHTML))
+	res, err := env.RenderNamedString("a.txt", "{{ x }}", ctx)
+	noError(t, err)
+	isEqual(t, "&lt;b&gt;", res)
+
+	res, err = env.RenderNamedString("a.txt", "{{ x|safe }}", ctx)
+	noError(t, err)
+	isEqual(t, "<b>", res)
+
+	noError(t, env.SetAutoEscape(minijinja.AutoEscapeNone))
+	res, err = env.RenderNamedString("a.html", "{{ x }}", ctx)
+	noError(t, err)
+	isEqual(t, "<b>", res)
+
+	noError(t, env.SetAutoEscape(minijinja.AutoEscapeDefault))
+	res, err = env.RenderNamedString("a.html", "{{ x }}", ctx)
+	noError(t, err)
+	isEqual(t, "&lt;b&gt;", res)
+}
+
+func TestEnvironment_SetAutoEscapeAfterAddTemplate(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	ctx := map[string]any{"x": "<b>"}
+
+	noError(t, env.AddTemplate("a.txt", "{{ x }}"))
+	noError(t, env.SetAutoEscape(minijinja.AutoEscapeHTML))
+
+	res, err := env.RenderTemplate("a.txt", ctx)
+	noError(t, err)
+	isEqual(t, "&lt;b&gt;", res)
+
+	noError(t, env.SetAutoEscapeCallback(nil))
+
+	res, err = env.RenderTemplate("a.txt", ctx)
+	noError(t, err)
+	isEqual(t, "<b>", res)
+}
+
+// lineSyntax is a syntax with line statements and line comments.
+var lineSyntax = minijinja.SyntaxConfig{
+	BlockStart:          "{%",
+	BlockEnd:            "%}",
+	VariableStart:       "{{",
+	VariableEnd:         "}}",
+	CommentStart:        "{#",
+	CommentEnd:          "#}",
+	LineStatementPrefix: "#",
+	LineCommentPrefix:   "//",
+}
+
+func TestEnvironment_SetAutoEscapeLineStatements(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	noError(t, env.SetSyntaxConfig(&lineSyntax))
+
+	src := "{{ x }}\n# if true\n{{ x }}\n# endif\n// comment\nend\n"
+	want, err := env.RenderNamedString(
+		"a.txt", src, map[string]any{"x": "&lt;b&gt;"},
+	)
+	noError(t, err)
+	isTrue(t, !strings.Contains(want, "#"))
+	isTrue(t, !strings.Contains(want, "comment"))
+
+	noError(t, env.SetAutoEscape(minijinja.AutoEscapeHTML))
+
+	ctx := map[string]any{"x": "<b>"}
+	res, err := env.RenderNamedString("a.txt", src, ctx)
+	noError(t, err)
+	isEqual(t, want, res)
+
+	for _, src := range []string{
+		"# if true\n{{ x }}\n# endif\n", "  // comment\n{{ x }}",
+	} {
+		_, err = env.RenderNamedString("b.txt", src, ctx)
+		var mjErr *minijinja.Error
+		isTrue(t, errors.As(err, &mjErr))
+		isEqual(t, minijinja.ErrorKindInvalidOperation, mjErr.Kind)
+
+		err = env.AddTemplate("b.txt", src)
+		isTrue(t, errors.As(err, &mjErr))
+	}
+
+	noError(t, env.SetAutoEscape(minijinja.AutoEscapeDefault))
+	res, err = env.RenderNamedString(
+		"b.txt", "# if true\n{{ x }}\n# endif", ctx,
+	)
+	noError(t, err)
+	isEqual(t, "<b>", strings.TrimSpace(res))
+}
+
+func TestEnvironment_SetAutoEscapeRollback(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	noError(t, env.SetSyntaxConfig(&lineSyntax))
+
+	names := []string{"a.txt", "b.txt", "c.txt", "d.txt"}
+	for _, name := range names {
+		noError(t, env.AddTemplate(name, "{{ x }}"))
+	}
+	noError(t, env.AddTemplate("line.txt", "# if true\n{{ x }}\n# endif"))
+
+	err := env.SetAutoEscape(minijinja.AutoEscapeHTML)
+	var mjErr *minijinja.Error
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, minijinja.ErrorKindInvalidOperation, mjErr.Kind)
+
+	ctx := map[string]any{"x": "<b>"}
+	for _, name := range names {
+		res, err := env.RenderTemplate(name, ctx)
+		noError(t, err)
+		isEqual(t, "<b>", res)
+	}
+
+	res, err := env.RenderNamedString("e.txt", "{{ x }}", ctx)
+	noError(t, err)
+	isEqual(t, "<b>", res)
+}
+
+func TestEnvironment_SetAutoEscapeTrailingNewline(t *testing.T) {
+	t.Parallel()
+
+	plain := minijinja.NewEnvironment()
+	defer plain.Close()
+	escaping := minijinja.NewEnvironment()
+	defer escaping.Close()
+
+	for _, env := range []*minijinja.Environment{plain, escaping} {
+		env.SetKeepTrailingNewline(true)
+	}
+	noError(t, escaping.SetAutoEscape(minijinja.AutoEscapeHTML))
+
+	for _, src := range []string{
+		"{{ x }}\n",
+		"{{ x -}}\n",
+		"{{ x }}{% if true -%}\n{% endif -%}\n\n",
+		"{{ x }}{# comment -#}\r\n",
+	} {
+		want, err := plain.RenderNamedString(
+			"a.txt", src, map[string]any{"x": "&lt;b&gt;"},
+		)
+		noError(t, err)
+
+		res, err := escaping.RenderNamedString(
+			"a.txt", src, map[string]any{"x": "<b>"},
+		)
+		noError(t, err)
+		isEqual(t, want, res)
+	}
+}
+
+func TestEnvironment_SetAutoEscapeCallback(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	env.SetTrimBlocks(true)
+	env.SetLStripBlocks(true)
+	env.SetKeepTrailingNewline(true)
+	byExt := func(name string) minijinja.AutoEscape {
+		if strings.HasSuffix(name, ".email") {
+			return minijinja.AutoEscapeHTML
+		}
+		return minijinja.AutoEscapeNone
+	}
+	noError(t, env.SetAutoEscapeCallback(byExt))
+
+	src := "\n  {{ x }}\n  "
+	noError(t, env.AddTemplate("body.email", src+"\n"))
+	noError(t, env.AddTemplate("body.html", src))
+
+	ctx := map[string]any{"x": "<b>"}
+
+	res, err := env.RenderTemplate("body.email", ctx)
+	noError(t, err)
+	isEqual(t, "\n  &lt;b&gt;\n  \n", res)
+
+	res, err = env.RenderTemplate("body.html", ctx)
+	noError(t, err)
+	isEqual(t, "\n  <b>\n  ", res)
+}
+
 func TestEnvironment_RemoveTemplate(t *testing.T) {
 	t.Parallel()
 
@@ -99,6 +335,81 @@ func TestEnvironment_RenderTemplate(t *testing.T) {
 	isEqual(t, "6", s)
 }
 
+func TestEnvironment_RenderTemplateTo(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	err := env.AddTemplate("sum", "{{ 1 + 2 + x }}")
+	isEqual(t, nil, err)
+
+	var b strings.Builder
+	err = env.RenderTemplateTo(&b, "sum", map[string]int{
+		"x": 3,
+	})
+	isEqual(t, nil, err)
+	isEqual(t, "6", b.String())
+
+	b.Reset()
+	err = env.RenderNamedStringTo(
+		&b, "hello", "Hello {{ name }}!", map[string]string{"name": "Go"},
+	)
+	isEqual(t, nil, err)
+	isEqual(t, "Hello Go!", b.String())
+}
+
+var (
+	errWriter     = errors.New("writer error")
+	errUnexpected = errors.New("unexpected value")
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWriter
+}
+
+func TestEnvironment_RenderTemplateToWriteError(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	err := env.AddTemplate("hello", "Hello!")
+	isEqual(t, nil, err)
+
+	err = env.RenderTemplateTo(failingWriter{}, "hello", nil)
+	isTrue(t, err != nil)
+	var mjErr *minijinja.Error
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, minijinja.ErrorKindWriteFailure, mjErr.Kind)
+	isTrue(t, errors.Is(err, errWriter))
+}
+
+func TestEnvironment_RenderTemplateContext(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	err := env.AddTemplate("sum", "{{ 1 + 2 + x }}")
+	isEqual(t, nil, err)
+	err = env.AddTemplate("loop", `{% for i in range(3000) %}`+
+		`{% for j in range(3000) %}{% endfor %}{% endfor %}`)
+	isEqual(t, nil, err)
+
+	ctx := context.Background()
+	s, err := env.RenderTemplateContext(ctx, "sum", map[string]int{"x": 3})
+	isEqual(t, nil, err)
+	isEqual(t, "6", s)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	_, err = env.RenderTemplateContext(ctx, "loop", nil)
+	isTrue(t, errors.Is(err, context.DeadlineExceeded))
+}
+
 func TestEnvironment_RenderTemplateError(t *testing.T) {
 	t.Parallel()
 
@@ -125,6 +436,98 @@ func TestEnvironment_EvalExpr(t *testing.T) {
 	isEqual(t, 6, res)
 }
 
+func TestEnvironment_EvalExprContext(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	var res float64
+	ctx := context.Background()
+	err := env.EvalExprContext(ctx, "1 + 2 + x", map[string]int{
+		"x": 3,
+	}, &res)
+	isEqual(t, nil, err)
+	isEqual(t, 6, res)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = env.EvalExprContext(ctx, "1 + 2", nil, &res)
+	isTrue(t, errors.Is(err, context.Canceled))
+}
+
+func TestEnvironment_EvalExprWithOptions(t *testing.T) {
+	t.Parallel()
+
+	type server struct {
+		Host string `minijinja:"host"`
+		Port int    `minijinja:"port"`
+		TLS  bool   `minijinja:"tls,omitempty"`
+	}
+	type config struct {
+		Servers []server `minijinja:"servers"`
+	}
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	tests := []struct {
+		name string
+		expr string
+		opts minijinja.EvalExprOptions
+		err  string
+	}{{
+		name: "lenient",
+		expr: "{'servers': [{'host': 'a', 'hots': 'b'}], 'x': 1}",
+	}, {
+		name: "unknown field",
+		expr: "{'servers': [{'host': 'a', 'port': 1}, {'hots': 'b'}]}",
+		opts: minijinja.EvalExprOptions{DisallowUnknownFields: true},
+		err:  `minijinja: unknown field "servers[1].hots"`,
+	}, {
+		name: "missing field",
+		expr: "{'servers': [{'host': 'a'}]}",
+		opts: minijinja.EvalExprOptions{RequireAllFields: true},
+		err:  `minijinja: missing field "servers[0].port"`,
+	}, {
+		name: "optional field",
+		expr: "{'servers': [{'host': 'a', 'port': 1}]}",
+		opts: minijinja.EvalExprOptions{RequireAllFields: true},
+	}, {
+		name: "undefined value",
+		expr: "{'servers': [{'host': host}]}",
+		opts: minijinja.EvalExprOptions{ErrorOnUndefined: true},
+		err:  `minijinja: undefined value "servers[0].host"`,
+	}, {
+		name: "missing value",
+		expr: "{'servers': [{'port': 1}]}",
+		opts: minijinja.EvalExprOptions{ErrorOnUndefined: true},
+	}, {
+		name: "undefined result",
+		expr: "cfg",
+		opts: minijinja.EvalExprOptions{ErrorOnUndefined: true},
+		err:  "minijinja: undefined value",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var res config
+			err := env.EvalExprWithOptions(tt.expr, nil, &res, tt.opts)
+			if tt.err == "" {
+				noError(t, err)
+				return
+			}
+
+			isTrue(t, err != nil)
+			var mjErr *minijinja.StrictDecodeError
+			isTrue(t, errors.As(err, &mjErr))
+			isEqual(t, tt.err, mjErr.Error())
+		})
+	}
+}
+
 func TestEnvironment_EvalExprError(t *testing.T) {
 	t.Parallel()
 
@@ -151,3 +554,90 @@ func TestEnvironment_EvalExprInvalid(t *testing.T) {
 	isTrue(t, errors.As(err, &mjErr))
 	isEqual(t, reflect.TypeFor[struct{}](), mjErr.Type)
 }
+
+func TestEnvironment_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	err := env.AddTemplate("hello", "Hello {{ name }}!")
+	isEqual(t, nil, err)
+	err = env.AddGlobal("site", "Go")
+	isEqual(t, nil, err)
+
+	const goroutines, iterations = 16, 100
+	errs := make(chan error, goroutines+1)
+
+	var wg sync.WaitGroup
+	for i := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range iterations {
+				name := fmt.Sprintf("%d-%d", i, j)
+				s, err := env.RenderTemplate("hello", map[string]string{
+					"name": name,
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if s != "Hello "+name+"!" {
+					errs <- fmt.Errorf("%w: output %q", errUnexpected, s)
+					return
+				}
+
+				_, err = env.RenderTemplate("missing-"+name, nil)
+				var mjErr *minijinja.Error
+				if !errors.As(err, &mjErr) ||
+					mjErr.Detail != fmt.Sprintf(
+						"template %q does not exist", "missing-"+name,
+					) {
+					errs <- fmt.Errorf("unexpected error: %w", err)
+					return
+				}
+
+				var res string
+				err = env.EvalExpr("site ~ x", map[string]string{
+					"x": name,
+				}, &res)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if res != "Go"+name {
+					errs <- fmt.Errorf("%w: result %q", errUnexpected, res)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := range iterations {
+			name := fmt.Sprintf("template-%d", j)
+			if err := env.AddTemplate(name, "{{ name }}"); err != nil {
+				errs <- err
+				return
+			}
+			env.SetTrimBlocks(j%2 == 0)
+			if err := env.AddGlobal("counter", j); err != nil {
+				errs <- err
+				return
+			}
+			if err := env.RemoveTemplate(name); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -109,6 +109,8 @@ type Error struct {
 	Line uint32
 	// All known debug info on format.
 	DebugInfo string
+
+	err error
 }
 
 func getError() *Error {
@@ -152,6 +154,9 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("minijinja: %s: %s", e.Kind, e.Detail)
 }
 
+// Unwrap returns the underlying error, if any.
+func (e *Error) Unwrap() error { return e.err }
+
 func isErrorSet() bool {
 	return bool(C.mj_err_is_set())
 }
@@ -177,6 +182,24 @@ func (e *DecodeTypeError) Error() string {
 	)
 }
 
+// A StrictDecodeError describes a value rejected by one of the
+// [EvalExprOptions].
+type StrictDecodeError struct {
+	// path of the value, like "servers[0].port", empty for the result itself
+	Path string
+	// reason it was rejected: "unknown field", "missing field" or
+	// "undefined value"
+	Reason string
+}
+
+func (e *StrictDecodeError) Error() string {
+	if e.Path == "" {
+		return "minijinja: " + e.Reason
+	}
+
+	return fmt.Sprintf("minijinja: %s %q", e.Reason, e.Path)
+}
+
 // An InvalidEvalExprError describes an invalid argument passed to [EvalExpr].
 // (The argument to [EvalExpr] must be a non-nil pointer.)
 type InvalidEvalExprError struct {
@@ -195,8 +218,45 @@ func (e *InvalidEvalExprError) Error() string {
 	return fmt.Sprintf("minijinja: EvalExpr(nil %s)", e.Type)
 }
 
-// A MarshalerError represents an error from calling an
-// [encoding.BinaryMarshaler.MarshalBinary] or
+// An InvalidExportsError describes an invalid argument passed to
+// [Template.Exports]. (The argument must be a non-nil pointer.)
+type InvalidExportsError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidExportsError) Error() string {
+	if e.Type == nil {
+		return "minijinja: Exports(nil)"
+	}
+
+	if e.Type.Kind() != reflect.Pointer {
+		return fmt.Sprintf("minijinja: Exports(non-pointer %s)", e.Type)
+	}
+
+	return fmt.Sprintf("minijinja: Exports(nil %s)", e.Type)
+}
+
+// An InvalidUnmarshalError describes an invalid argument passed to the
+// unmarshal function of [Unmarshaler.UnmarshalMiniJinja]. (The argument must
+// be a non-nil pointer.)
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "minijinja: unmarshal(nil)"
+	}
+
+	if e.Type.Kind() != reflect.Pointer {
+		return fmt.Sprintf("minijinja: unmarshal(non-pointer %s)", e.Type)
+	}
+
+	return fmt.Sprintf("minijinja: unmarshal(nil %s)", e.Type)
+}
+
+// A MarshalerError represents an error from calling a
+// [Marshaler.MarshalMiniJinja], [encoding.BinaryMarshaler.MarshalBinary] or
 // [encoding.TextMarshaler.MarshalText] method.
 type MarshalerError struct {
 	Type       reflect.Type
@@ -217,6 +277,7 @@ func (e *MarshalerError) Error() string {
 func (e *MarshalerError) Unwrap() error { return e.Err }
 
 // A UnmarshalerError represents an error from calling an
+// [Unmarshaler.UnmarshalMiniJinja],
 // [encoding.BinaryUnmarshaler.UnmarshalBinary] or
 // [encoding.TextUnmarshaler.UnmarshalText] method.
 type UnmarshalerError struct {
@@ -248,3 +309,14 @@ func (e *UnsupportedTypeError) Error() string {
 	return "minijinja: cannot encode Go value of unsupported type " +
 		e.Type.String()
 }
+
+// An UnsupportedValueError is returned when attempting to encode an
+// unsupported value.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "minijinja: unsupported value: " + e.Str
+}
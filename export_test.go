@@ -0,0 +1,7 @@
+package minijinja
+
+// MissingTemplateName extracts the name of the missing template from an
+// [ErrorKindTemplateNotFound] error.
+func MissingTemplateName(err *Error) (string, bool) {
+	return missingTemplateName(err)
+}
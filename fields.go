@@ -0,0 +1,324 @@
+package minijinja
+
+import (
+	"cmp"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const jsonTagName = "json"
+
+// field describes how a struct field maps to a key of a MiniJinja map.
+type field struct {
+	name      string
+	tagged    bool
+	index     []int
+	typ       reflect.Type
+	omitEmpty bool
+	quoted    bool
+}
+
+type fieldsKey struct {
+	rt       reflect.Type
+	jsonTags bool
+}
+
+// fieldsCache caches the fields of struct types, keyed by fieldsKey.
+var fieldsCache sync.Map
+
+// cachedTypeFields is like typeFields but uses a cache.
+func cachedTypeFields(rt reflect.Type, jsonTags bool) []field {
+	key := fieldsKey{rt: rt, jsonTags: jsonTags}
+	if f, ok := fieldsCache.Load(key); ok {
+		return f.([]field) //nolint:forcetypeassert
+	}
+
+	f, _ := fieldsCache.LoadOrStore(key, typeFields(rt, jsonTags))
+	return f.([]field) //nolint:forcetypeassert
+}
+
+// typeFields returns the fields of a struct type, following the same rules
+// as encoding/json. The fields of untagged embedded structs and of the
+// structs tagged with the inline option are promoted to the parent struct.
+// When several fields share a name, the shallowest one wins, then the tagged
+// one; if it is still ambiguous, all of them are dropped.
+func typeFields(rt reflect.Type, jsonTags bool) []field {
+	var current []field
+	next := []field{{typ: rt}}
+
+	// Number of times each type is seen at the current and the next depth.
+	var count map[reflect.Type]int
+	nextCount := map[reflect.Type]int{}
+
+	visited := map[reflect.Type]bool{}
+
+	var fields []field
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, map[reflect.Type]int{}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := range f.typ.NumField() {
+				sf := f.typ.Field(i)
+				ft := sf.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+
+				if sf.Anonymous {
+					// Exported fields of unexported embedded structs are
+					// still promoted.
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+
+				tag, ok := sf.Tag.Lookup(tagName)
+				if !ok && jsonTags {
+					tag = sf.Tag.Get(jsonTagName)
+				}
+				if tag == "-" {
+					continue
+				}
+
+				name, opts := parseTag(tag)
+
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				promote := (sf.Anonymous && name == "") ||
+					opts.contains("inline")
+				if !promote || ft.Kind() != reflect.Struct {
+					if !sf.IsExported() {
+						continue
+					}
+
+					tagged := name != ""
+					if !tagged {
+						name = sf.Name
+					}
+
+					fields = append(fields, field{
+						name:      name,
+						tagged:    tagged,
+						index:     index,
+						typ:       ft,
+						omitEmpty: opts.contains("omitempty"),
+						quoted: opts.contains("string") &&
+							isQuotable(sf.Type),
+					})
+
+					// If the parent struct was seen several times at this
+					// depth, duplicate the field so that it is dropped as
+					// ambiguous below.
+					if count[f.typ] > 1 {
+						fields = append(fields, fields[len(fields)-1])
+					}
+					continue
+				}
+
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, field{index: index, typ: ft})
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(fields, func(a, b field) int {
+		if c := cmp.Compare(a.name, b.name); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(len(a.index), len(b.index)); c != 0 {
+			return c
+		}
+		if a.tagged != b.tagged {
+			if a.tagged {
+				return -1
+			}
+			return 1
+		}
+		return slices.Compare(a.index, b.index)
+	})
+
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		fi := fields[i]
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != fi.name {
+				break
+			}
+		}
+		if dominant, ok := dominantField(fields[i : i+advance]); ok {
+			out = append(out, dominant)
+		}
+	}
+
+	slices.SortFunc(out, func(a, b field) int {
+		return slices.Compare(a.index, b.index)
+	})
+
+	return out
+}
+
+// dominantField returns the field that wins among fields sharing the same
+// name, sorted by depth and then by tag. It reports false if none of them
+// dominates the others.
+func dominantField(fields []field) (field, bool) {
+	if len(fields) > 1 &&
+		len(fields[0].index) == len(fields[1].index) &&
+		fields[0].tagged == fields[1].tagged {
+		return field{}, false
+	}
+
+	return fields[0], true
+}
+
+// fieldValue returns the value of the field at index in the struct rv.
+// If alloc is true, nil pointers to embedded structs are allocated, otherwise
+// it reports false when it encounters one. It also reports false if such a
+// pointer cannot be set, like an embedded pointer to an unexported struct.
+func fieldValue(
+	rv reflect.Value, index []int, alloc bool,
+) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				if !alloc || !rv.CanSet() {
+					return reflect.Value{}, false
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+
+	return rv, true
+}
+
+// tagOptions is the string following a comma in a struct field tag.
+type tagOptions string
+
+// parseTag splits a struct field tag into its name and options.
+func parseTag(tag string) (string, tagOptions) {
+	name, opts, _ := strings.Cut(tag, ",")
+	return name, tagOptions(opts)
+}
+
+// contains reports whether a comma-separated list of options contains a
+// particular option.
+func (o tagOptions) contains(option string) bool {
+	s := string(o)
+	for s != "" {
+		var opt string
+		opt, s, _ = strings.Cut(s, ",")
+		if opt == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isEmptyValue reports whether rv is empty, as defined by the omitempty
+// option.
+func isEmptyValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool,
+		reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr,
+		reflect.Interface, reflect.Pointer:
+		return rv.IsZero()
+	}
+
+	return false
+}
+
+// isQuotable reports whether the string option applies to a type.
+func isQuotable(rt reflect.Type) bool {
+	switch rt.Kind() {
+	case reflect.Bool,
+		reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+
+	return false
+}
+
+// quote formats a boolean or a number as a string.
+func quote(rv reflect.Value) string {
+	switch rv.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool())
+	case reflect.Float32:
+		return strconv.FormatFloat(rv.Float(), 'g', -1, 32)
+	case reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'g', -1, 64)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(rv.Uint(), 10)
+	}
+
+	panic("unexpected kind: " + rv.Kind().String())
+}
+
+// unquote parses a string into the boolean or number rv.
+// It reports false if the string is not valid for the type of rv.
+func unquote(rv reflect.Value, s string) bool {
+	switch rv.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return false
+		}
+		rv.SetBool(b)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, rv.Type().Bits())
+		if err != nil {
+			return false
+		}
+		rv.SetFloat(f)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, rv.Type().Bits())
+		if err != nil {
+			return false
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, rv.Type().Bits())
+		if err != nil {
+			return false
+		}
+		rv.SetUint(n)
+	default:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,206 @@
+package minijinja
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// notFoundDetailRegexp matches the detail of [ErrorKindTemplateNotFound]
+// errors and captures the quoted template name.
+var notFoundDetailRegexp = regexp.MustCompile(
+	`^template (".*") does not exist`,
+)
+
+// Loader resolves a template name to its source. It reports whether the
+// template was found, or an error if the template could not be loaded.
+type Loader func(name string) (source string, found bool, err error)
+
+// SetLoader registers a template loader with the environment.
+//
+// Templates that are not registered with [Environment.AddTemplate] are
+// requested from the loader when rendering, including targets of `include`,
+// `extends` and `import` tags. Loaded templates are added to the environment
+// and are not requested again until removed. Passing nil removes the loader.
+//
+// The loader may be called concurrently by renders running in multiple
+// goroutines.
+//
+// The C ABI cannot call back into Go, so a render which needs a missing
+// template fails, the template is loaded, and the render starts over from
+// scratch. A render needing N templates which are not loaded yet is
+// therefore run up to N+1 times: register templates ahead of time with
+// [Environment.AddTemplate] when this matters. The name of the missing
+// template is parsed from the error message of the engine, so names which
+// the engine quotes with Rust escapes, like control characters, cannot be
+// loaded.
+func (e *Environment) SetLoader(loader Loader) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.loader = loader
+}
+
+// withLoader calls render and, when it fails on a missing template, loads
+// that template through the loader and calls render again.
+func (e *Environment) withLoader(render func() error) error {
+	e.mu.RLock()
+	loader := e.loader
+	e.mu.RUnlock()
+	if loader == nil {
+		return render()
+	}
+
+	loaded := make(map[string]bool)
+	for {
+		err := render()
+
+		var mjErr *Error
+		if !errors.As(err, &mjErr) ||
+			mjErr.Kind != ErrorKindTemplateNotFound {
+			return err
+		}
+
+		name, ok := missingTemplateName(mjErr)
+		if !ok || loaded[name] {
+			return err
+		}
+
+		found, loadErr := e.loadTemplate(loader, name)
+		if loadErr != nil {
+			return loadErr
+		}
+		if !found {
+			return err
+		}
+		loaded[name] = true
+	}
+}
+
+// loadTemplate requests a template from the loader and adds it to the
+// environment. It reports whether the template was found.
+func (e *Environment) loadTemplate(
+	loader Loader, name string,
+) (bool, error) {
+	source, found, err := loader(name)
+	if err != nil {
+		return false, &Error{
+			Kind:   ErrorKindInvalidOperation,
+			Detail: fmt.Sprintf("could not load template %q: %s", name, err),
+			err:    err,
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	if err := e.AddTemplate(name, source); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// missingTemplateName extracts the name of the missing template from a
+// [ErrorKindTemplateNotFound] error.
+func missingTemplateName(err *Error) (string, bool) {
+	m := notFoundDetailRegexp.FindStringSubmatch(err.Detail)
+	if m == nil {
+		return "", false
+	}
+
+	name, uErr := strconv.Unquote(m[1])
+	if uErr != nil {
+		return "", false
+	}
+
+	return name, true
+}
+
+// FSLoaderOption configures a loader created by [FSLoader].
+type FSLoaderOption func(*fsLoader)
+
+// WithExtensions makes the loader try each of the given extensions, in order,
+// when no file matches the template name exactly.
+//
+// A template is registered under the name it was requested with, not the
+// name of the file it was read from. The auto-escaping mode is chosen from
+// the template name, so a file like pages/hello.html loaded as pages/hello
+// is not escaped for HTML by default. Request such templates with their
+// extension, or set the mode with [Environment.SetAutoEscape].
+func WithExtensions(exts ...string) FSLoaderOption {
+	return func(l *fsLoader) {
+		l.exts = append(l.exts, exts...)
+	}
+}
+
+// WithCache makes the loader keep the sources it has read in memory.
+func WithCache() FSLoaderOption {
+	return func(l *fsLoader) {
+		l.cache = make(map[string]string)
+	}
+}
+
+// fsLoader loads templates from a [fs.FS].
+type fsLoader struct {
+	fsys fs.FS
+	exts []string
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+// FSLoader returns a [Loader] which resolves template names as paths in fsys,
+// such as an [embed.FS].
+//
+// Names must be valid [fs.FS] paths: absolute paths and names containing `.`
+// or `..` elements are treated as not found.
+//
+// See [WithExtensions] for the auto-escaping of templates requested without
+// their extension.
+func FSLoader(fsys fs.FS, opts ...FSLoaderOption) Loader {
+	l := &fsLoader{fsys: fsys}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l.load
+}
+
+func (l *fsLoader) load(name string) (string, bool, error) {
+	if !fs.ValidPath(name) {
+		return "", false, nil
+	}
+
+	if l.cache != nil {
+		l.mu.Lock()
+		source, ok := l.cache[name]
+		l.mu.Unlock()
+		if ok {
+			return source, true, nil
+		}
+	}
+
+	for _, ext := range append([]string{""}, l.exts...) {
+		b, err := fs.ReadFile(l.fsys, name+ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+
+		source := string(b)
+		if l.cache != nil {
+			l.mu.Lock()
+			l.cache[name] = source
+			l.mu.Unlock()
+		}
+
+		return source, true, nil
+	}
+
+	return "", false, nil
+}
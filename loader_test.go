@@ -0,0 +1,180 @@
+package minijinja_test
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/maxbrunet/minijinja-go/v2"
+)
+
+var errLoader = errors.New("loader error")
+
+func TestEnvironment_SetLoader(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	templates := map[string]string{
+		"base": "<{% block body %}{% endblock %}>",
+		"hello": `{% extends "base" %}{% block body %}` +
+			`{% include "name" %}{% endblock %}`,
+		"name": "{{ name }}",
+	}
+	calls := 0
+	env.SetLoader(func(name string) (string, bool, error) {
+		calls++
+		source, ok := templates[name]
+		return source, ok, nil
+	})
+
+	s, err := env.RenderTemplate("hello", map[string]string{"name": "Go"})
+	isEqual(t, nil, err)
+	isEqual(t, "<Go>", s)
+	isEqual(t, 3, calls)
+
+	s, err = env.RenderTemplate("hello", map[string]string{"name": "World"})
+	isEqual(t, nil, err)
+	isEqual(t, "<World>", s)
+	isEqual(t, 3, calls)
+}
+
+// TestEnvironment_SetLoaderErrorFormat fails if the engine changes the
+// format of the message the loader relies on to find missing templates.
+func TestEnvironment_SetLoaderErrorFormat(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	for _, name := range []string{
+		"missing", "dir/missing.html", `say "hi"`, `back\slash`, "café",
+	} {
+		_, err := env.RenderNamedString(
+			"hello", "{% include name %}", map[string]string{"name": name},
+		)
+		var mjErr *minijinja.Error
+		isTrue(t, errors.As(err, &mjErr))
+		isEqual(t, minijinja.ErrorKindTemplateNotFound, mjErr.Kind)
+
+		got, ok := minijinja.MissingTemplateName(mjErr)
+		if !ok || got != name {
+			t.Fatalf(
+				"cannot parse template name %q from error detail %q",
+				name, mjErr.Detail,
+			)
+		}
+	}
+}
+
+func TestEnvironment_SetLoaderNotFound(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	env.SetLoader(func(string) (string, bool, error) {
+		return "", false, nil
+	})
+
+	_, err := env.RenderNamedString("hello", `{% include "missing" %}`, nil)
+	isTrue(t, err != nil)
+	var mjErr *minijinja.Error
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, minijinja.ErrorKindTemplateNotFound, mjErr.Kind)
+}
+
+func TestEnvironment_SetLoaderError(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	env.SetLoader(func(string) (string, bool, error) {
+		return "", false, errLoader
+	})
+
+	_, err := env.RenderTemplate("hello", nil)
+	isTrue(t, err != nil)
+	var mjErr *minijinja.Error
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, minijinja.ErrorKindInvalidOperation, mjErr.Kind)
+	isTrue(t, errors.Is(err, errLoader))
+}
+
+func TestFSLoader(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"base.html": {Data: []byte("<{% block body %}{% endblock %}>")},
+		"pages/hello.html": {Data: []byte(
+			`{% extends "base.html" %}{% block body %}` +
+				`{% include "partials/name" %}{% endblock %}`,
+		)},
+		"partials/name.j2": {Data: []byte("{{ name }}")},
+	}
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	env.SetLoader(
+		minijinja.FSLoader(fsys, minijinja.WithExtensions(".html", ".j2")),
+	)
+
+	s, err := env.RenderTemplate("pages/hello", map[string]string{
+		"name": "Go",
+	})
+	isEqual(t, nil, err)
+	isEqual(t, "<Go>", s)
+}
+
+func TestFSLoaderAutoEscape(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"hello.html": {Data: []byte("{{ name }}")},
+	}
+	ctx := map[string]string{"name": "<Go>"}
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	env.SetLoader(minijinja.FSLoader(fsys, minijinja.WithExtensions(".html")))
+
+	s, err := env.RenderTemplate("hello.html", ctx)
+	isEqual(t, nil, err)
+	isEqual(t, "&lt;Go&gt;", s)
+
+	// The template is registered as "hello", which the default mode does
+	// not escape.
+	s, err = env.RenderTemplate("hello", ctx)
+	isEqual(t, nil, err)
+	isEqual(t, "<Go>", s)
+
+	noError(t, env.SetAutoEscape(minijinja.AutoEscapeHTML))
+	s, err = env.RenderTemplate("hello", ctx)
+	isEqual(t, nil, err)
+	isEqual(t, "&lt;Go&gt;", s)
+}
+
+func TestFSLoaderInvalidPath(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello")},
+	}
+	loader := minijinja.FSLoader(fsys, minijinja.WithCache())
+
+	names := []string{"/hello.txt", "../hello.txt", "a/../hello.txt"}
+	for _, name := range names {
+		_, found, err := loader(name)
+		isEqual(t, nil, err)
+		isTrue(t, !found)
+	}
+
+	source, found, err := loader("hello.txt")
+	isEqual(t, nil, err)
+	isTrue(t, found)
+	isEqual(t, "hello", source)
+}
@@ -0,0 +1,172 @@
+package minijinja
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"strings"
+)
+
+// Context keys of the templates generated by [Template] methods.
+const (
+	templateNameKey = "__minijinja_template"
+	macroNameKey    = "__minijinja_macro"
+	macroArgsKey    = "__minijinja_args"
+	macroKwargsKey  = "__minijinja_kwargs"
+	exportValueKey  = "__minijinja_value"
+)
+
+// exportsFilter selects the exports which can be decoded, skipping macros.
+const exportsFilter = "v is string or v is number or v is boolean or " +
+	"v is none or v is mapping or v is sequence"
+
+// Kwargs holds the keyword arguments of a macro call.
+// See [Template.CallMacro].
+type Kwargs map[string]any
+
+// Template is a handle on a template of an [Environment].
+type Template struct {
+	env  *Environment
+	name string
+}
+
+// Template returns a handle on the template with the given name. It does
+// not evaluate nor check anything: a template which does not exist is
+// reported, or requested from the loader, when the handle is used.
+func (e *Environment) Template(name string) *Template {
+	return &Template{env: e, name: name}
+}
+
+// Name returns the name of the template.
+func (t *Template) Name() string {
+	return t.name
+}
+
+// CallMacro calls a macro defined at the top level of the template and
+// returns its output. If the last argument is a [Kwargs], its entries are
+// passed as keyword arguments, the other arguments are passed as positional
+// arguments.
+//
+// The macro is imported with the import tag on each call, which evaluates
+// the top-level code of the template without the render context.
+func (t *Template) CallMacro(name string, args ...any) (string, error) {
+	kwargs := Kwargs{}
+	if n := len(args); n > 0 {
+		if kw, ok := args[n-1].(Kwargs); ok {
+			args = args[:n-1]
+			if kw != nil {
+				kwargs = kw
+			}
+		}
+	}
+	if args == nil {
+		args = []any{}
+	}
+
+	syntax := t.env.syntaxConfig()
+	return t.renderGenerated(
+		syntax.block("import "+templateNameKey+" as t")+
+			syntax.variable(
+				"t["+macroNameKey+"](*"+macroArgsKey+", **"+macroKwargsKey+")",
+			),
+		map[string]any{
+			macroNameKey:   name,
+			macroArgsKey:   args,
+			macroKwargsKey: kwargs,
+		},
+	)
+}
+
+// Exports decodes the variables set at the top level of the template into
+// the value pointed by data, like [Environment.EvalExpr] decodes the result
+// of an expression. Like [Template.CallMacro], it evaluates the top-level code
+// of the template without the render context.
+//
+// The C ABI cannot return values from a template, so they are passed through
+// their string representation and evaluated back. Only strings, numbers,
+// booleans, none, and lists and maps of them are exported: macros and other
+// objects are skipped. Safe strings are exported as plain strings. Values
+// which cannot be evaluated back to an equal value, like NaN or strings with
+// control characters, fail with an [Error] of kind
+// [ErrorKindBadSerialization].
+func (t *Template) Exports(data any) error {
+	rv := reflect.ValueOf(data)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidExportsError{Type: reflect.TypeOf(data)}
+	}
+
+	// Each export is rendered on its own line as its name and the string
+	// representation of a list holding its value, which quotes strings and
+	// always escapes newlines.
+	syntax := t.env.syntaxConfig()
+	out, err := t.renderGenerated(
+		syntax.block("import "+templateNameKey+" as t")+
+			syntax.block("for k, v in t|items if "+exportsFilter)+
+			syntax.variable("k|safe")+"="+syntax.variable("[v]|string|safe")+
+			"\n"+syntax.block("endfor"),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	exports := newValueObject()
+	defer exports.Close()
+
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		name, repr, _ := strings.Cut(line, "=")
+
+		val, err := t.evalExport(name, repr)
+		if err != nil {
+			return err
+		}
+
+		err = exports.setKeyValue(newValueString(name), val)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.env.decoder().decode(exports, rv.Elem())
+}
+
+// evalExport evaluates the string representation of a list holding the
+// value of an export, checks that the resulting list has the same
+// representation, and returns the value.
+func (t *Template) evalExport(name, repr string) (*value, error) {
+	badExport := &Error{
+		Kind:   ErrorKindBadSerialization,
+		Detail: fmt.Sprintf("cannot export %s of value %s", name, repr),
+	}
+
+	list, err := t.env.evalExpr(repr, nil)
+	if err != nil {
+		return nil, badExport
+	}
+	defer list.Close()
+
+	syntax := t.env.syntaxConfig()
+	got, err := t.renderGenerated(
+		syntax.variable(exportValueKey+"|string|safe"),
+		map[string]any{exportValueKey: Value{h: &valueHandle{val: list}}},
+	)
+	if err != nil || got != repr || list.len() != 1 {
+		return nil, badExport
+	}
+
+	return list.fieldByIndex(0), nil
+}
+
+// renderGenerated renders a template generated to operate on the template,
+// whose name is available under templateNameKey in addition to vars.
+func (t *Template) renderGenerated(
+	source string, vars map[string]any,
+) (string, error) {
+	ctx := map[string]any{templateNameKey: t.name}
+	maps.Copy(ctx, vars)
+
+	return t.env.RenderNamedString(t.name, source, ctx)
+}
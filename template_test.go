@@ -0,0 +1,117 @@
+package minijinja_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/maxbrunet/minijinja-go/v2"
+)
+
+func TestEnvironment_Template(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	tmpl := env.Template("not-found")
+	isEqual(t, "not-found", tmpl.Name())
+}
+
+const macros = `{% set title = "Components" %}
+{% set sizes = {"sm": 1, "lg": [2, 3.5]} %}
+{% macro button(label, kind="primary") -%}
+<button class="{{ kind }}">{{ label }}</button>
+{%- endmacro %}`
+
+func TestTemplate_CallMacro(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	noError(t, env.AddTemplate("components.html", macros))
+
+	tmpl := env.Template("components.html")
+
+	res, err := tmpl.CallMacro("button", "<OK>")
+	noError(t, err)
+	isEqual(t, `<button class="primary">&lt;OK&gt;</button>`, res)
+
+	res, err = tmpl.CallMacro(
+		"button", minijinja.Kwargs{"label": "Cancel", "kind": "secondary"},
+	)
+	noError(t, err)
+	isEqual(t, `<button class="secondary">Cancel</button>`, res)
+
+	_, err = tmpl.CallMacro("missing")
+	isTrue(t, err != nil)
+}
+
+func TestTemplate_Exports(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	noError(t, env.AddTemplate("components.html", macros))
+
+	tmpl := env.Template("components.html")
+
+	var exports struct {
+		Title string `minijinja:"title"`
+		Sizes struct {
+			Small int       `minijinja:"sm"`
+			Large []float64 `minijinja:"lg"`
+		} `minijinja:"sizes"`
+		Button any `minijinja:"button"`
+	}
+	err := tmpl.Exports(&exports)
+	noError(t, err)
+	isEqual(t, "Components", exports.Title)
+	isEqual(t, 1, exports.Sizes.Small)
+	isEqual(t, 2, len(exports.Sizes.Large))
+	isEqual(t, 3.5, exports.Sizes.Large[1])
+	isEqual(t, nil, exports.Button)
+
+	err = tmpl.Exports(nil)
+	var invalidErr *minijinja.InvalidExportsError
+	isTrue(t, errors.As(err, &invalidErr))
+	isEqual(t, "minijinja: Exports(nil)", invalidErr.Error())
+}
+
+func TestTemplate_ExportsBadSerialization(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	noError(t, env.AddTemplate("nan.html", `{% set nan = "nan"|float %}`))
+
+	var exports map[string]any
+	err := env.Template("nan.html").Exports(&exports)
+
+	var mjErr *minijinja.Error
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, minijinja.ErrorKindBadSerialization, mjErr.Kind)
+}
+
+func TestTemplate_CallMacroLoader(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	env.SetLoader(func(name string) (string, bool, error) {
+		return macros, name == "loaded.html", nil
+	})
+
+	res, err := env.Template("loaded.html").CallMacro("button", "Go")
+	noError(t, err)
+	isEqual(t, `<button class="primary">Go</button>`, res)
+
+	_, err = env.Template("not-found").CallMacro("button")
+
+	var mjErr *minijinja.Error
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, minijinja.ErrorKindTemplateNotFound, mjErr.Kind)
+}
@@ -14,6 +14,8 @@ package minijinja
 // #cgo nocallback mj_value_get_by_value
 // #cgo noescape mj_value_get_kind
 // #cgo nocallback mj_value_get_kind
+// #cgo noescape mj_value_incref
+// #cgo nocallback mj_value_incref
 // #cgo noescape mj_value_iter_free
 // #cgo nocallback mj_value_iter_free
 // #cgo noescape mj_value_iter_next
@@ -31,10 +33,13 @@ package minijinja
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"iter"
 	"math"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -42,43 +47,223 @@ const (
 	tagName = "minijinja"
 )
 
+// liveHandles counts the environments and values owned by Go which have not
+// been released yet. See [LiveHandles].
+var liveHandles atomic.Int64
+
+// LiveHandles returns the number of environments and values owned by Go which
+// have not been released yet, including the values held internally by
+// environments, like globals.
+//
+// It is meant for tests and debugging: a test can check that the count
+// returns to its initial value once every [Environment] and [Value] it
+// created is closed. Renders running concurrently in other goroutines also
+// change the count.
+func LiveHandles() int64 {
+	return liveHandles.Load()
+}
+
+// ErrClosedValue is returned when using a [Value] after it has been closed.
+var ErrClosedValue = errors.New("minijinja: use of closed value")
+
+// Value is an encoded MiniJinja value.
+//
+// A Value is accepted anywhere a context or a Go value is, and is used as is,
+// without being encoded again. This allows a large dataset to be encoded once
+// and shared by many renders. Copies of a Value refer to the same underlying
+// value, which is released once [Value.Close] is called. A Value is safe for
+// concurrent use by multiple goroutines.
+//
+// The underlying value is also released when the Value becomes unreachable,
+// but this should not be relied upon.
+//
+// When a map Value is used as a render context and the environment has
+// globals, its top-level entries are copied on every render to merge the
+// globals without modifying the shared value. Nested values are not copied.
+// Pass shared datasets under a key of a small context map to avoid the copy.
+//
+// The zero Value represents none.
+type Value struct {
+	h *valueHandle
+}
+
+// valueHandle holds the reference of a [Value] on the underlying value.
+type valueHandle struct {
+	mu  sync.RWMutex
+	val *value
+}
+
+// SafeString is a string which is already safe to include in the output of a
+// template, like pre-sanitized HTML, and is never auto-escaped. Values of
+// type [html/template.HTML] are encoded as safe strings too.
+//
+// Any string can be decoded into a SafeString. Safe strings are decoded as
+// SafeString into interfaces only with the SafeStrings option of
+// [EvalExprOptions], so that they stay safe when passed back to a template.
+type SafeString string
+
+// Marshaler is the interface implemented by types that can encode themselves
+// into MiniJinja values. MarshalMiniJinja returns a Go value which is encoded
+// in place of the receiver, like a map, a slice or a number.
+type Marshaler interface {
+	MarshalMiniJinja() (any, error)
+}
+
+// Unmarshaler is the interface implemented by types that can decode
+// MiniJinja values into themselves. The unmarshal function decodes the value
+// into the Go value pointed to by its argument, which lets the type decode it
+// into an intermediate representation first. Calling unmarshal with the
+// receiver itself recurses indefinitely: use a type without the method
+// instead. Calling unmarshal with anything but a non-nil pointer returns an
+// [InvalidUnmarshalError]. None and undefined values are not passed to
+// UnmarshalMiniJinja.
+type Unmarshaler interface {
+	UnmarshalMiniJinja(unmarshal func(any) error) error
+}
+
+// ValueOption configures the encoding of a [Value].
+type ValueOption func(*encoder)
+
+// WithJSONTags makes the struct fields without a minijinja tag use their
+// json tag, if any. See [Environment.SetJSONTags].
+func WithJSONTags() ValueOption {
+	return func(enc *encoder) {
+		enc.jsonTags = true
+	}
+}
+
+// ValueOf encodes x into a [Value].
+func ValueOf(x any, opts ...ValueOption) (Value, error) {
+	enc := &encoder{}
+	for _, opt := range opts {
+		opt(enc)
+	}
+
+	val, err := enc.newValue(x)
+	if err != nil {
+		return Value{}, err
+	}
+
+	h := &valueHandle{val: val}
+	runtime.SetFinalizer(h, (*valueHandle).close)
+
+	return Value{h: h}, nil
+}
+
+// Close releases the underlying value. Renders which already started with
+// the value are not affected. Closing a closed Value has no effect.
+func (v Value) Close() error {
+	if v.h == nil {
+		return nil
+	}
+
+	v.h.close()
+	runtime.SetFinalizer(v.h, nil)
+
+	return nil
+}
+
+func (h *valueHandle) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.val != nil {
+		_ = h.val.Close()
+		h.val = nil
+	}
+}
+
+// clone returns a new reference on the underlying value.
+func (v Value) clone() (*value, error) {
+	if v.h == nil {
+		return newValueNone(), nil
+	}
+
+	v.h.mu.RLock()
+	defer v.h.mu.RUnlock()
+	if v.h.val == nil {
+		return nil, ErrClosedValue
+	}
+
+	return v.h.val.clone(), nil
+}
+
 // value represents an opaque MiniJinja value.
 type value struct {
-	cVal C.struct_mj_value
+	cVal     C.struct_mj_value
+	released bool
+}
+
+// wrapValue wraps a value owned by the caller.
+func wrapValue(cVal C.struct_mj_value) *value {
+	liveHandles.Add(1)
+	return &value{cVal: cVal}
 }
 
 // Close decrements the value refcount.
+// Closing a released value has no effect.
 func (v *value) Close() error {
+	if v.released {
+		return nil
+	}
+
 	C.mj_value_decref(&v.cVal)
+	v.release()
+
 	return nil
 }
 
-// setKey inserts a value into an object using a string key.
-// It returns an error if the operation fails.
-func (v *value) setKey(key, val any) error {
-	kVal, err := newValue(key)
-	if err != nil {
-		return err
-	}
+// release marks the value as released, either because it was closed, or
+// because its ownership was transferred to the engine.
+func (v *value) release() {
+	v.released = true
+	liveHandles.Add(-1)
+}
 
-	vVal, err := newValue(val)
-	if err != nil {
-		return err
-	}
+// clone increments the value refcount and returns a new handle to it.
+func (v *value) clone() *value {
+	cVal := v.cVal
+	C.mj_value_incref(&cVal)
+	return wrapValue(cVal)
+}
 
+// setKeyValue inserts an already encoded value into an object.
+// The key and the value are consumed, even if the operation fails.
+// It returns an error if the operation fails.
+func (v *value) setKeyValue(key, val *value) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	if !bool(C.mj_value_set_key(&v.cVal, kVal.cVal, vVal.cVal)) {
+	ok := bool(C.mj_value_set_key(&v.cVal, key.cVal, val.cVal))
+	key.release()
+	val.release()
+	if !ok {
 		return getError()
 	}
 
 	return nil
 }
 
+// copyMap returns a shallow copy of a map.
+func (v *value) copyMap() (*value, error) {
+	vIter, err := v.newIter()
+	if err != nil {
+		return nil, err
+	}
+
+	obj := newValueObject()
+	for key := range vIter {
+		if err := obj.setKeyValue(key, v.key(key)); err != nil {
+			_ = obj.Close()
+			return nil, err
+		}
+	}
+
+	return obj, nil
+}
+
 // fieldByIndex looks up an element by an integer index in a list of object.
 func (v *value) fieldByIndex(index int) *value {
 	cVal := C.mj_value_get_by_index(v.cVal, C.uint64_t(index))
-	return &value{cVal: cVal}
+	return wrapValue(cVal)
 }
 
 // fieldByName looks up an element by a string index in an object.
@@ -88,21 +273,24 @@ func (v *value) fieldByName(name string) *value {
 
 	cVal := C.mj_value_get_by_str(v.cVal, key)
 
-	return &value{cVal: cVal}
+	return wrapValue(cVal)
 }
 
 // key looks up an element by a value.
 func (v *value) key(key *value) *value {
 	cVal := C.mj_value_get_by_value(v.cVal, key.cVal)
-	return &value{cVal: cVal}
+	return wrapValue(cVal)
 }
 
 // append appends a value to a list.
+// The value is consumed, even if appending fails.
 // It returns an error if appending fails.
 func (v *value) append(val *value) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
-	if !bool(C.mj_value_append(&v.cVal, val.cVal)) {
+	ok := bool(C.mj_value_append(&v.cVal, val.cVal))
+	val.release()
+	if !ok {
 		return getError()
 	}
 
@@ -147,13 +335,14 @@ type valueIter struct {
 }
 
 // newIter creates an [iter.Seq] for the value.
+// Each yielded value must be closed by the caller.
 func (v *value) newIter() (iter.Seq[*value], error) {
 	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 	cIter := C.mj_value_try_iter(v.cVal)
 	if cIter == nil {
 		return nil, getError()
 	}
-	runtime.UnlockOSThread()
 
 	return func(yield func(*value) bool) {
 		for {
@@ -161,7 +350,7 @@ func (v *value) newIter() (iter.Seq[*value], error) {
 			if C.mj_value_iter_next(cIter, &cVal) != C.bool(true) {
 				break
 			}
-			if !yield(&value{cVal: cVal}) {
+			if !yield(wrapValue(cVal)) {
 				break
 			}
 		}
@@ -16,19 +16,86 @@ import "C"
 
 import (
 	"encoding"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"unsafe"
 )
 
 var (
+	bigIntType            = reflect.TypeFor[big.Int]()
 	binaryUnmarshalerType = reflect.TypeFor[encoding.BinaryUnmarshaler]()
 	textUnmarshalerType   = reflect.TypeFor[encoding.TextUnmarshaler]()
+	unmarshalerType       = reflect.TypeFor[Unmarshaler]()
 )
 
+// ErrUnexportedEmbeddedPointer is returned when decoding into a field
+// promoted through a nil pointer to an unexported embedded struct, which
+// cannot be allocated.
+var ErrUnexportedEmbeddedPointer = errors.New(
+	"minijinja: cannot set embedded pointer to unexported struct",
+)
+
+// decoder decodes values into Go values.
+type decoder struct {
+	// jsonTags makes struct fields without a minijinja tag use their json tag.
+	jsonTags bool
+	// opts makes the decoding strict, see [EvalExprOptions].
+	opts EvalExprOptions
+	// path locates the value being decoded, for strict decoding errors.
+	path []pathElem
+	// inKey is set while decoding a map key.
+	inKey bool
+}
+
+// strict reports whether one of the strict decoding options is set.
+func (d *decoder) strict() bool {
+	return d.opts.DisallowUnknownFields || d.opts.RequireAllFields ||
+		d.opts.ErrorOnUndefined
+}
+
+// pathElem is an element of the path of a decoded value: a key, or an index
+// if key is empty.
+type pathElem struct {
+	key   string
+	index int
+}
+
+// push appends an element to the path of the value being decoded.
+func (d *decoder) push(e pathElem) { d.path = append(d.path, e) }
+
+// pop removes the last element from the path of the value being decoded.
+func (d *decoder) pop() { d.path = d.path[:len(d.path)-1] }
+
+// strictError returns a StrictDecodeError for the value being decoded.
+func (d *decoder) strictError(reason string) error {
+	var b strings.Builder
+	for _, e := range d.path {
+		if e.key == "" {
+			b.WriteString("[" + strconv.Itoa(e.index) + "]")
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(e.key)
+	}
+
+	return &StrictDecodeError{Path: b.String(), Reason: reason}
+}
+
 // decode decodes a value and stores the result into the variable pointed by rv.
-func (v *value) decode(rv reflect.Value) error {
+func (d *decoder) decode(v *value, rv reflect.Value) error {
 	kind := v.kind()
+	if kind == valueKindUndefined && d.opts.ErrorOnUndefined {
+		return d.strictError("undefined value")
+	}
+
 	if rv.Kind() == reflect.Pointer {
 		if kind == valueKindNone || kind == valueKindUndefined {
 			return nil
@@ -37,22 +104,27 @@ func (v *value) decode(rv reflect.Value) error {
 		if rv.IsNil() {
 			rv.Set(reflect.New(rv.Type().Elem()))
 		}
-		return v.decode(rv.Elem())
+		return d.decode(v, rv.Elem())
+	}
+
+	if kind != valueKindNone && kind != valueKindUndefined &&
+		reflect.PointerTo(rv.Type()).Implements(unmarshalerType) {
+		return d.decodeUnmarshaler(v, rv)
 	}
 
 	switch kind {
 	case valueKindBool:
-		return v.decodeBool(rv)
+		return d.decodeBool(v, rv)
 	case valueKindBytes:
-		return v.decodeBytes(rv)
+		return d.decodeBytes(v, rv)
 	case valueKindNumber:
-		return v.decodeNumber(rv)
+		return d.decodeNumber(v, rv)
 	case valueKindPlain, valueKindString:
-		return v.decodeString(rv)
+		return d.decodeString(v, rv)
 	case valueKindSeq:
-		return v.decodeSeq(rv)
+		return d.decodeSeq(v, rv)
 	case valueKindMap, valueKindIterable:
-		return v.decodeMap(rv)
+		return d.decodeMap(v, rv)
 	case valueKindNone, valueKindUndefined:
 		return nil
 	case valueKindInvalid:
@@ -63,7 +135,36 @@ func (v *value) decode(rv reflect.Value) error {
 	}
 }
 
-func (v *value) decodeBool(rv reflect.Value) error {
+// decodeUnmarshaler decodes a value with the [Unmarshaler] implementation of
+// the type of rv.
+func (d *decoder) decodeUnmarshaler(v *value, rv reflect.Value) error {
+	rt := rv.Type()
+	uv := reflect.New(rt)
+	u, ok := uv.Interface().(Unmarshaler)
+	if !ok {
+		return &DecodeTypeError{Value: v.kind().String(), Type: rt}
+	}
+
+	err := u.UnmarshalMiniJinja(func(x any) error {
+		xv := reflect.ValueOf(x)
+		if xv.Kind() != reflect.Pointer || xv.IsNil() {
+			return &InvalidUnmarshalError{Type: reflect.TypeOf(x)}
+		}
+		return d.decode(v, xv.Elem())
+	})
+	if err != nil {
+		return &UnmarshalerError{
+			Type:       rt,
+			Err:        err,
+			sourceFunc: "UnmarshalMiniJinja",
+		}
+	}
+	rv.Set(uv.Elem())
+
+	return nil
+}
+
+func (d *decoder) decodeBool(v *value, rv reflect.Value) error {
 	b := bool(C.mj_value_is_true(v.cVal))
 
 	switch rv.Kind() {
@@ -80,7 +181,7 @@ func (v *value) decodeBool(rv reflect.Value) error {
 	return &DecodeTypeError{Value: v.kind().String(), Type: rv.Type()}
 }
 
-func (v *value) decodeBytes(rv reflect.Value) error {
+func (d *decoder) decodeBytes(v *value, rv reflect.Value) error {
 	length := C.uintptr_t(0)
 	charPtr := C.mj_value_as_bytes(v.cVal, &length)
 	bytes := C.GoBytes(unsafe.Pointer(charPtr), C.int(length))
@@ -104,19 +205,21 @@ func (v *value) decodeBytes(rv reflect.Value) error {
 
 	switch rv.Kind() {
 	case reflect.Array:
-		return v.decodeBytesToArray(rv, bytes)
+		return d.decodeBytesToArray(v, rv, bytes)
 	case reflect.Slice:
-		return v.decodeBytesToSlice(rv, bytes)
+		return d.decodeBytesToSlice(v, rv, bytes)
 	case reflect.Interface:
 		if rv.NumMethod() == 0 {
-			return v.decodeBytesToSlice(rv, bytes)
+			return d.decodeBytesToSlice(v, rv, bytes)
 		}
 	}
 
 	return &DecodeTypeError{Value: v.kind().String(), Type: rv.Type()}
 }
 
-func (v *value) decodeBytesToArray(rv reflect.Value, bytes []byte) error {
+func (d *decoder) decodeBytesToArray(
+	v *value, rv reflect.Value, bytes []byte,
+) error {
 	rt := rv.Type().Elem().Kind()
 	for i, b := range bytes {
 		if i >= rv.Len() {
@@ -149,7 +252,9 @@ func (v *value) decodeBytesToArray(rv reflect.Value, bytes []byte) error {
 	return nil
 }
 
-func (v *value) decodeBytesToSlice(rv reflect.Value, bytes []byte) error {
+func (d *decoder) decodeBytesToSlice(
+	v *value, rv reflect.Value, bytes []byte,
+) error {
 	var s reflect.Value
 	if rv.Kind() == reflect.Interface {
 		if rv.NumMethod() > 0 {
@@ -190,7 +295,7 @@ func (v *value) decodeBytesToSlice(rv reflect.Value, bytes []byte) error {
 	return nil
 }
 
-func (v *value) decodeMap(rv reflect.Value) error {
+func (d *decoder) decodeMap(v *value, rv reflect.Value) error {
 	var rt reflect.Type
 	switch rv.Kind() {
 	case reflect.Interface:
@@ -206,7 +311,7 @@ func (v *value) decodeMap(rv reflect.Value) error {
 			rv.Set(reflect.MakeMapWithSize(rt, v.len()))
 		}
 	case reflect.Struct:
-		return v.decodeMapToStruct(rv)
+		return d.decodeMapToStruct(v, rv)
 	default:
 		return &DecodeTypeError{Value: v.kind().String(), Type: rv.Type()}
 	}
@@ -220,88 +325,325 @@ func (v *value) decodeMap(rv reflect.Value) error {
 	valueType := rt.Elem()
 
 	for key := range vIter {
-		val := v.key(key)
-
-		kv := reflect.New(keyType)
-		if err := key.decode(kv); err != nil {
+		kv, vv, err := d.decodeMapEntry(v, key, keyType, valueType)
+		if err != nil {
 			return err
 		}
 
-		vv := reflect.New(valueType)
-		if err := val.decode(vv); err != nil {
+		rv.SetMapIndex(kv, vv)
+	}
+
+	return nil
+}
+
+// decodeMapEntry decodes a key and its value and closes the key.
+func (d *decoder) decodeMapEntry(
+	v, key *value, keyType, valueType reflect.Type,
+) (reflect.Value, reflect.Value, error) {
+	defer key.Close()
+
+	val := v.key(key)
+	defer val.Close()
+
+	kv := reflect.New(keyType)
+	d.inKey = true
+	err := d.decode(key, kv)
+	d.inKey = false
+	if err != nil {
+		return reflect.Value{}, reflect.Value{}, err
+	}
+
+	if d.strict() {
+		d.push(pathElem{key: key.String()})
+		defer d.pop()
+	}
+
+	vv := reflect.New(valueType)
+	if err := d.decode(val, vv); err != nil {
+		return reflect.Value{}, reflect.Value{}, err
+	}
+
+	return kv.Elem(), vv.Elem(), nil
+}
+
+func (d *decoder) decodeMapToStruct(v *value, rv reflect.Value) error {
+	fields := cachedTypeFields(rv.Type(), d.jsonTags)
+
+	var keys map[string]bool
+	if d.strict() {
+		var err error
+		if keys, err = d.checkKeys(v, fields); err != nil {
 			return err
 		}
+	}
 
-		rv.SetMapIndex(kv.Elem(), vv.Elem())
+	for _, f := range fields {
+		val := v.fieldByName(f.name)
+		d.push(pathElem{key: f.name})
+		err := d.decodeField(val, rv, f, keys)
+		d.pop()
+		_ = val.Close()
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (v *value) decodeMapToStruct(rv reflect.Value) error {
-	rt := rv.Type()
-
-	for i := range rt.NumField() {
-		ft := rt.Field(i)
-		fv := rv.Field(i)
+// checkKeys returns the set of the keys of the map v. It returns an error if
+// unknown fields are disallowed and a key does not match any of the fields.
+func (d *decoder) checkKeys(
+	v *value, fields []field,
+) (map[string]bool, error) {
+	vIter, err := v.newIter()
+	if err != nil {
+		return nil, err
+	}
 
-		if !fv.CanSet() {
-			continue
+	keys := make(map[string]bool)
+	for key := range vIter {
+		name := key.String()
+		_ = key.Close()
+		keys[name] = true
+
+		if d.opts.DisallowUnknownFields &&
+			!slices.ContainsFunc(fields, func(f field) bool {
+				return f.name == name
+			}) {
+			d.push(pathElem{key: name})
+			err := d.strictError("unknown field")
+			d.pop()
+			return nil, err
 		}
+	}
 
-		name := ft.Tag.Get(tagName)
-		if name == "-" {
-			continue
-		}
-		if name == "" {
-			name = ft.Name
+	return keys, nil
+}
+
+// decodeField decodes a value into the field f of the struct rv. keys holds
+// the keys of the map being decoded, to tell missing fields from undefined
+// values when decoding strictly.
+func (d *decoder) decodeField(
+	v *value, rv reflect.Value, f field, keys map[string]bool,
+) error {
+	if v.kind() == valueKindUndefined {
+		switch {
+		case keys[f.name] && d.opts.ErrorOnUndefined:
+			return d.strictError("undefined value")
+		case !keys[f.name] && d.opts.RequireAllFields && !f.omitEmpty:
+			return d.strictError("missing field")
 		}
+		return nil
+	}
 
-		val := v.fieldByName(name)
+	fv, ok := fieldValue(rv, f.index, true)
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnexportedEmbeddedPointer, rv.Type())
+	}
 
-		if err := val.decode(fv); err != nil {
-			return err
+	if f.quoted && v.kind() == valueKindString {
+		if s := v.String(); !unquote(fv, s) {
+			return &DecodeTypeError{
+				Value: fmt.Sprintf("%s %q", v.kind(), s), Type: fv.Type(),
+			}
 		}
+		return nil
 	}
 
-	return nil
+	return d.decode(v, fv)
 }
 
-func (v *value) decodeNumber(rv reflect.Value) error {
+func (d *decoder) decodeNumber(v *value, rv reflect.Value) error {
+	if decodeNativeNumber(v, rv) {
+		return nil
+	}
+
+	s := v.String()
+
+	if rv.Type() == bigIntType {
+		n, ok := new(big.Int).SetString(s, 10)
+		if ok {
+			rv.Set(reflect.ValueOf(n).Elem())
+			return nil
+		}
+	}
+
 	switch rv.Kind() {
 	case reflect.Float32, reflect.Float64:
-		rv.SetFloat(float64(C.mj_value_as_f64(v.cVal)))
-		return nil
-	case reflect.Int, reflect.Int32, reflect.Int64:
-		rv.SetInt(int64(C.mj_value_as_i64(v.cVal)))
-		return nil
+		f, ok := parseFloat(s, rv.Type().Bits())
+		if ok && !rv.OverflowFloat(f) {
+			rv.SetFloat(f)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		n, ok := parseInt(s)
+		if ok && !rv.OverflowInt(n) {
+			rv.SetInt(n)
+			return nil
+		}
 	case reflect.Interface:
-		if rv.NumMethod() == 0 {
-			rv.Set(reflect.ValueOf(float64(C.mj_value_as_f64(v.cVal))))
+		if rv.NumMethod() > 0 {
+			break
+		}
+		if n, ok := parseNumber(s); ok {
+			rv.Set(reflect.ValueOf(n))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		n, ok := parseUint(s)
+		if ok && !rv.OverflowUint(n) {
+			rv.SetUint(n)
 			return nil
 		}
-	case reflect.Uint, reflect.Uint32, reflect.Uint64:
-		rv.SetUint(uint64(C.mj_value_as_u64(v.cVal)))
-		return nil
 	}
 
 	return &DecodeTypeError{
-		Value: fmt.Sprintf("%s %s", v.kind(), v), Type: rv.Type(),
+		Value: fmt.Sprintf("%s %s", v.kind(), s), Type: rv.Type(),
+	}
+}
+
+// decodeNativeNumber decodes a number with the accessors of the C ABI,
+// without formatting it as a string. The accessors return zero for the
+// numbers they cannot convert, so it reports false for zero and for the
+// numbers which may not be decoded exactly, which must be decoded from their
+// string representation instead.
+func decodeNativeNumber(v *value, rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f, ok := nativeFloat(v, rv.Type().Bits())
+		if ok && !rv.OverflowFloat(f) {
+			rv.SetFloat(f)
+			return true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		n := int64(C.mj_value_as_i64(v.cVal))
+		if n != 0 && !rv.OverflowInt(n) {
+			rv.SetInt(n)
+			return true
+		}
+	case reflect.Interface:
+		if rv.NumMethod() > 0 {
+			break
+		}
+		if f, ok := nativeFloat(v, 64); ok {
+			rv.Set(reflect.ValueOf(f))
+			return true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		n := uint64(C.mj_value_as_u64(v.cVal))
+		if n != 0 && !rv.OverflowUint(n) {
+			rv.SetUint(n)
+			return true
+		}
+	}
+
+	return false
+}
+
+// nativeFloat converts a number into a float of the given bit size with the
+// accessors of the C ABI. It reports false for zero and for the integers
+// which the float may not represent exactly.
+func nativeFloat(v *value, bitSize int) (float64, bool) {
+	// Integers, and floats without a fractional part, convert to an int64.
+	if n := int64(C.mj_value_as_i64(v.cVal)); n != 0 {
+		limit := int64(1) << 53
+		if bitSize == 32 {
+			limit = 1 << 24
+		}
+		return float64(n), -limit <= n && n <= limit
+	}
+
+	// Only floats have a fractional part, or are NaN.
+	f := float64(C.mj_value_as_f64(v.cVal))
+	return f, f != math.Trunc(f)
+}
+
+// parseNumber parses a number as a float64, or as an int64, uint64 or
+// [*big.Int] if it is an integer which a float64 cannot represent exactly.
+func parseNumber(s string) (any, bool) {
+	if f, ok := parseFloat(s, 64); ok {
+		return f, true
+	}
+
+	n, ok := new(big.Int).SetString(s, 10)
+	switch {
+	case !ok:
+		return nil, false
+	case n.IsInt64():
+		return n.Int64(), true
+	case n.IsUint64():
+		return n.Uint64(), true
+	default:
+		return n, true
 	}
 }
 
-func (v *value) decodeSeq(rv reflect.Value) error {
+// parseFloat parses a number into a float of the given bit size. It reports
+// false if the number is an integer which the float cannot represent
+// exactly.
+func parseFloat(s string, bitSize int) (float64, bool) {
+	f, err := strconv.ParseFloat(s, bitSize)
+	if err != nil {
+		return 0, false
+	}
+
+	n, isInt := new(big.Int).SetString(s, 10)
+	if !isInt {
+		return f, true
+	}
+
+	exact, _ := big.NewFloat(f).Int(nil)
+	return f, exact.Cmp(n) == 0
+}
+
+// parseInt parses the string representation of a number as an int64.
+// It reports false if the number overflows or has a fractional part.
+func parseInt(s string) (int64, bool) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, true
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f != math.Trunc(f) || f < -(1<<63) || f >= 1<<63 {
+		return 0, false
+	}
+
+	return int64(f), true
+}
+
+// parseUint parses the string representation of a number as an uint64.
+// It reports false if the number is negative, overflows or has a fractional
+// part.
+func parseUint(s string) (uint64, bool) {
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, true
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f != math.Trunc(f) || f < 0 || f >= 1<<64 {
+		return 0, false
+	}
+
+	return uint64(f), true
+}
+
+func (d *decoder) decodeSeq(v *value, rv reflect.Value) error {
 	switch rv.Kind() {
 	case reflect.Array:
-		return v.decodeSeqToArray(rv)
+		return d.decodeSeqToArray(v, rv)
 	case reflect.Interface, reflect.Slice:
-		return v.decodeSeqToSlice(rv)
+		return d.decodeSeqToSlice(v, rv)
 	}
 
 	return &DecodeTypeError{Value: v.kind().String(), Type: rv.Type()}
 }
 
-func (v *value) decodeSeqToArray(rv reflect.Value) error {
+func (d *decoder) decodeSeqToArray(v *value, rv reflect.Value) error {
 	for i := range v.len() {
 		if i >= rv.Len() {
 			// Ran out of fixed array: skip.
@@ -309,8 +651,11 @@ func (v *value) decodeSeqToArray(rv reflect.Value) error {
 		}
 
 		val := v.fieldByIndex(i)
-
-		if err := val.decode(rv.Index(i)); err != nil {
+		d.push(pathElem{index: i})
+		err := d.decode(val, rv.Index(i))
+		d.pop()
+		_ = val.Close()
+		if err != nil {
 			return err
 		}
 	}
@@ -325,7 +670,7 @@ func (v *value) decodeSeqToArray(rv reflect.Value) error {
 	return nil
 }
 
-func (v *value) decodeSeqToSlice(rv reflect.Value) error {
+func (d *decoder) decodeSeqToSlice(v *value, rv reflect.Value) error {
 	var s reflect.Value
 	if rv.Kind() == reflect.Interface {
 		if rv.NumMethod() > 0 {
@@ -344,8 +689,11 @@ func (v *value) decodeSeqToSlice(rv reflect.Value) error {
 
 	for i := range v.len() {
 		val := v.fieldByIndex(i)
-
-		if err := val.decode(s.Index(i)); err != nil {
+		d.push(pathElem{index: i})
+		err := d.decode(val, s.Index(i))
+		d.pop()
+		_ = val.Close()
+		if err != nil {
 			return err
 		}
 	}
@@ -354,7 +702,7 @@ func (v *value) decodeSeqToSlice(rv reflect.Value) error {
 	return nil
 }
 
-func (v *value) decodeString(rv reflect.Value) error {
+func (d *decoder) decodeString(v *value, rv reflect.Value) error {
 	s := v.String()
 
 	rt := rv.Type()
@@ -379,11 +727,44 @@ func (v *value) decodeString(rv reflect.Value) error {
 		rv.SetString(s)
 		return nil
 	case reflect.Interface:
-		if rv.NumMethod() == 0 {
-			rv.Set(reflect.ValueOf(s))
-			return nil
+		if rv.NumMethod() > 0 {
+			break
+		}
+		if d.opts.SafeStrings && !d.inKey {
+			safe, err := isSafe(v)
+			if err != nil {
+				return err
+			}
+			if safe {
+				rv.Set(reflect.ValueOf(SafeString(s)))
+				return nil
+			}
 		}
+		rv.Set(reflect.ValueOf(s))
+		return nil
 	}
 
 	return &DecodeTypeError{Value: v.kind().String(), Type: rv.Type()}
 }
+
+// isSafe reports whether a value is a safe string.
+func isSafe(v *value) (bool, error) {
+	if v.kind() != valueKindString {
+		return false, nil
+	}
+
+	ctx := newValueObject()
+	err := ctx.setKeyValue(newValueString("s"), v.clone())
+	if err != nil {
+		_ = ctx.Close()
+		return false, err
+	}
+
+	res, err := evalLiteral("s is safe", ctx)
+	if err != nil {
+		return false, err
+	}
+	defer res.Close()
+
+	return bool(C.mj_value_is_true(res.cVal)), nil
+}
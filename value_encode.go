@@ -21,14 +21,86 @@ import "C"
 import (
 	"encoding"
 	"fmt"
+	"html/template"
 	"math"
+	"math/big"
 	"reflect"
+	"runtime"
+	"sync"
 	"unsafe"
 )
 
+var (
+	minInt128  = new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 127))
+	maxUint128 = new(big.Int).Sub(
+		new(big.Int).Lsh(big.NewInt(1), 128),
+		big.NewInt(1),
+	)
+)
+
+// literalEnv returns an environment used to create the values which have no
+// C ABI constructor, by evaluating literals.
+var literalEnv = sync.OnceValue(func() *C.struct_mj_env {
+	env := C.mj_env_new()
+	if env == nil {
+		panic("received nil env")
+	}
+
+	return env
+})
+
+// evalLiteral evaluates an expression with the literal environment.
+// The context is consumed.
+func evalLiteral(expr string, ctx *value) (*value, error) {
+	defer ctx.Close()
+
+	cExpr := C.CString(expr)
+	defer C.free(unsafe.Pointer(cExpr))
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cVal := C.mj_env_eval_expr(literalEnv(), cExpr, ctx.cVal)
+	if isErrorSet() {
+		return nil, getError()
+	}
+
+	return wrapValue(cVal), nil
+}
+
+// encoder encodes Go values into values.
+type encoder struct {
+	// jsonTags makes struct fields without a minijinja tag use their json tag.
+	jsonTags bool
+	// shared is the last value encoded as a new reference on a [Value].
+	shared *value
+}
+
+// isShared reports whether val is a new reference on a [Value], which is
+// shared with its other users and must not be modified.
+func (enc *encoder) isShared(val *value) bool {
+	return val != nil && val == enc.shared
+}
+
 // newValue creates a new value.
-func newValue(x any) (*value, error) { //nolint:cyclop
+func (enc *encoder) newValue(x any) (*value, error) { //nolint:cyclop
 	switch x := x.(type) {
+	case Value:
+		val, err := x.clone()
+		enc.shared = val
+		return val, err
+	case big.Int:
+		return newValueBigInt(&x)
+	case *big.Int:
+		if x == nil {
+			return newValueNone(), nil
+		}
+		return newValueBigInt(x)
+	case Marshaler:
+		return enc.newValueFromMarshaler(x)
+	case SafeString:
+		return newValueSafeString(string(x))
+	case template.HTML:
+		return newValueSafeString(string(x))
 	case encoding.TextMarshaler:
 		return newValueStringFromTextMarshaler(x)
 	case encoding.BinaryMarshaler:
@@ -43,6 +115,10 @@ func newValue(x any) (*value, error) { //nolint:cyclop
 		return newValueFloat64(x), nil
 	case int:
 		return newValueInt(x), nil
+	case int8:
+		return newValueInt32(int32(x)), nil
+	case int16:
+		return newValueInt32(int32(x)), nil
 	case int32:
 		return newValueInt32(x), nil
 	case int64:
@@ -53,10 +129,16 @@ func newValue(x any) (*value, error) { //nolint:cyclop
 		return newValueString(x), nil
 	case uint:
 		return newValueUint(x), nil
+	case uint8:
+		return newValueUint32(uint32(x)), nil
+	case uint16:
+		return newValueUint32(uint32(x)), nil
 	case uint32:
 		return newValueUint32(x), nil
 	case uint64:
 		return newValueUint64(x), nil
+	case uintptr:
+		return newValueUint64(uint64(x)), nil
 	}
 
 	rv := reflect.ValueOf(x)
@@ -65,31 +147,89 @@ func newValue(x any) (*value, error) { //nolint:cyclop
 		if rv.Type().Elem().Kind() == reflect.Uint8 {
 			return newValueBytes(x)
 		}
-		return newValueSeq(x)
+		return enc.newValueSeq(x)
+	case reflect.Chan:
+		if rv.Type().ChanDir()&reflect.RecvDir == 0 {
+			break
+		}
+		if rv.IsNil() {
+			return newValueNone(), nil
+		}
+		return enc.newValueChan(rv)
+	case reflect.Float32:
+		return newValueFloat32(float32(rv.Float())), nil
+	case reflect.Float64:
+		return newValueFloat64(rv.Float()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return newValueInt64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return newValueUint64(rv.Uint()), nil
+	case reflect.Func:
+		arity, ok := seqArity(rv.Type())
+		if !ok {
+			break
+		}
+		if rv.IsNil() {
+			return newValueNone(), nil
+		}
+		return enc.newValueIterSeq(rv, arity)
 	case reflect.Map:
 		if rv.IsNil() {
 			return newValueNone(), nil
 		}
-		return newValueMap(x)
+		return enc.newValueMap(x)
 	case reflect.Pointer:
 		if rv.IsNil() {
 			return newValueNone(), nil
 		}
-		return newValue(rv.Elem().Interface())
+		return enc.newValue(rv.Elem().Interface())
 	case reflect.Struct:
-		return newValueStruct(x)
+		return enc.newValueStruct(x)
 	case reflect.Slice:
 		if rv.IsNil() {
 			return newValueNone(), nil
 		}
-		return newValueSeq(x)
+		return enc.newValueSeq(x)
 	}
 
 	return nil, &UnsupportedTypeError{Type: rv.Type()}
 }
 
+// newValueBigInt encodes an integer which fits in 128 bits.
+func newValueBigInt(x *big.Int) (*value, error) {
+	if x.IsInt64() {
+		return newValueInt64(x.Int64()), nil
+	}
+	if x.IsUint64() {
+		return newValueUint64(x.Uint64()), nil
+	}
+	if x.Cmp(minInt128) < 0 || x.Cmp(maxUint128) > 0 {
+		return nil, &UnsupportedValueError{
+			Value: reflect.ValueOf(x),
+			Str:   x.String(),
+		}
+	}
+
+	// The C ABI has no constructor for 128-bit integers, so the integer is
+	// created by the engine from a literal.
+	var expr string
+	switch {
+	case x.Cmp(minInt128) == 0:
+		// The literal of the absolute value does not fit in an i128.
+		expr = new(big.Int).Add(x, big.NewInt(1)).String() + " - 1"
+	case x.Sign() < 0:
+		expr = "-" + new(big.Int).Neg(x).String()
+	default:
+		expr = x.String()
+	}
+
+	return evalLiteral(expr, newValueNone())
+}
+
 func newValueBool(x bool) *value {
-	return &value{cVal: C.mj_value_new_bool(C.bool(x))}
+	return wrapValue(C.mj_value_new_bool(C.bool(x)))
 }
 
 func newValueBytes(x any) (*value, error) {
@@ -117,9 +257,27 @@ func newValueBytes(x any) (*value, error) {
 		length = len(bytes)
 	}
 
-	return &value{
-		cVal: C.mj_value_new_bytes((*C.char)(ptr), C.uintptr_t(length)),
-	}, nil
+	return wrapValue(
+		C.mj_value_new_bytes((*C.char)(ptr), C.uintptr_t(length)),
+	), nil
+}
+
+// newValueFromMarshaler encodes the Go value returned by a [Marshaler].
+func (enc *encoder) newValueFromMarshaler(x Marshaler) (*value, error) {
+	if rv := reflect.ValueOf(x); rv.Kind() == reflect.Pointer && rv.IsNil() {
+		return newValueNone(), nil
+	}
+
+	y, err := x.MarshalMiniJinja()
+	if err != nil {
+		return nil, &MarshalerError{
+			Type:       reflect.TypeOf(x),
+			Err:        err,
+			sourceFunc: "MarshalMiniJinja",
+		}
+	}
+
+	return enc.newValue(y)
 }
 
 func newValueBytesFromBinaryMarshaler(
@@ -136,17 +294,43 @@ func newValueBytesFromBinaryMarshaler(
 	ptr := C.CBytes(b)
 	defer C.free(ptr)
 
-	return &value{
-		cVal: C.mj_value_new_bytes((*C.char)(ptr), C.uintptr_t(len(b))),
-	}, nil
+	return wrapValue(
+		C.mj_value_new_bytes((*C.char)(ptr), C.uintptr_t(len(b))),
+	), nil
+}
+
+// newValueChan receives from a channel until it is closed and returns the
+// received values as a seq.
+func (enc *encoder) newValueChan(rv reflect.Value) (*value, error) {
+	l := newValueList()
+
+	for {
+		x, ok := rv.Recv()
+		if !ok {
+			break
+		}
+
+		val, err := enc.newValue(x.Interface())
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+
+		if err := l.append(val); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
 }
 
 func newValueFloat32(x float32) *value {
-	return &value{cVal: C.mj_value_new_f32(C.float(x))}
+	return wrapValue(C.mj_value_new_f32(C.float(x)))
 }
 
 func newValueFloat64(x float64) *value {
-	return &value{cVal: C.mj_value_new_f64(C.double(x))}
+	return wrapValue(C.mj_value_new_f64(C.double(x)))
 }
 
 func newValueInt(x int) *value {
@@ -161,17 +345,78 @@ func newValueInt(x int) *value {
 }
 
 func newValueInt32(x int32) *value {
-	return &value{cVal: C.mj_value_new_i32(C.int32_t(x))}
+	return wrapValue(C.mj_value_new_i32(C.int32_t(x)))
 }
 
 func newValueInt64(x int64) *value {
-	return &value{cVal: C.mj_value_new_i64(C.int64_t(x))}
+	return wrapValue(C.mj_value_new_i64(C.int64_t(x)))
+}
+
+// seqArity reports whether rt is the type of an [iter.Seq] or an [iter.Seq2]
+// function, and the number of values passed to its yield function.
+func seqArity(rt reflect.Type) (int, bool) {
+	if rt.NumIn() != 1 || rt.NumOut() != 0 || rt.IsVariadic() {
+		return 0, false
+	}
+
+	yield := rt.In(0)
+	if yield.Kind() != reflect.Func || yield.IsVariadic() ||
+		yield.NumOut() != 1 || yield.Out(0).Kind() != reflect.Bool {
+		return 0, false
+	}
+
+	switch n := yield.NumIn(); n {
+	case 1, 2:
+		return n, true
+	}
+
+	return 0, false
+}
+
+// newValueIterSeq runs an [iter.Seq] function and returns the yielded values
+// as a seq, or an [iter.Seq2] function and returns the yielded pairs as a seq
+// of two-element seqs.
+func (enc *encoder) newValueIterSeq(
+	rv reflect.Value, arity int,
+) (*value, error) {
+	l := newValueList()
+
+	var err error
+	yieldType := rv.Type().In(0)
+	yield := reflect.MakeFunc(
+		yieldType,
+		func(args []reflect.Value) []reflect.Value {
+			var x any
+			if arity == 1 {
+				x = args[0].Interface()
+			} else {
+				x = [2]any{args[0].Interface(), args[1].Interface()}
+			}
+
+			var val *value
+			if val, err = enc.newValue(x); err == nil {
+				err = l.append(val)
+			}
+
+			return []reflect.Value{
+				reflect.ValueOf(err == nil).Convert(yieldType.Out(0)),
+			}
+		},
+	)
+	rv.Call([]reflect.Value{yield})
+
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return l, nil
 }
 
-func newValueMap(x any) (*value, error) {
+func (enc *encoder) newValueMap(x any) (*value, error) {
 	rv := reflect.ValueOf(x)
 
-	obj := &value{cVal: C.mj_value_new_object()}
+	obj := newValueObject()
 
 	for _, kv := range rv.MapKeys() {
 		vv := rv.MapIndex(kv)
@@ -190,7 +435,8 @@ func newValueMap(x any) (*value, error) {
 			v = vv.Interface()
 		}
 
-		if err := obj.setKey(k, v); err != nil {
+		if err := enc.setKey(obj, k, v); err != nil {
+			_ = obj.Close()
 			return nil, err
 		}
 	}
@@ -198,22 +444,32 @@ func newValueMap(x any) (*value, error) {
 	return obj, nil
 }
 
+func newValueList() *value {
+	return wrapValue(C.mj_value_new_list())
+}
+
 func newValueNone() *value {
-	return &value{cVal: C.mj_value_new_none()}
+	return wrapValue(C.mj_value_new_none())
 }
 
-func newValueSeq(x any) (*value, error) {
+func newValueObject() *value {
+	return wrapValue(C.mj_value_new_object())
+}
+
+func (enc *encoder) newValueSeq(x any) (*value, error) {
 	rv := reflect.ValueOf(x)
 
-	l := &value{cVal: C.mj_value_new_list()}
+	l := newValueList()
 
 	for i := range rv.Len() {
-		val, err := newValue(rv.Index(i).Interface())
+		val, err := enc.newValue(rv.Index(i).Interface())
 		if err != nil {
+			_ = l.Close()
 			return nil, err
 		}
 
 		if err := l.append(val); err != nil {
+			_ = l.Close()
 			return nil, err
 		}
 	}
@@ -221,11 +477,42 @@ func newValueSeq(x any) (*value, error) {
 	return l, nil
 }
 
+// setKey encodes a key and a value and inserts them into an object.
+// It returns an error if the operation fails.
+func (enc *encoder) setKey(obj *value, key, val any) error {
+	kVal, err := enc.newValue(key)
+	if err != nil {
+		return err
+	}
+
+	vVal, err := enc.newValue(val)
+	if err != nil {
+		_ = kVal.Close()
+		return err
+	}
+
+	return obj.setKeyValue(kVal, vVal)
+}
+
 func newValueString(s string) *value {
 	cStr := C.CString(s)
 	defer C.free(unsafe.Pointer(cStr))
 
-	return &value{cVal: C.mj_value_new_string(cStr)}
+	return wrapValue(C.mj_value_new_string(cStr))
+}
+
+// newValueSafeString creates a string which is not auto-escaped.
+func newValueSafeString(s string) (*value, error) {
+	// The C ABI has no constructor for safe strings, so the string is marked
+	// as safe by the engine.
+	ctx := newValueObject()
+	err := ctx.setKeyValue(newValueString("s"), newValueString(s))
+	if err != nil {
+		_ = ctx.Close()
+		return nil, err
+	}
+
+	return evalLiteral("s|safe", ctx)
 }
 
 func newValueStringFromTextMarshaler(x encoding.TextMarshaler) (*value, error) {
@@ -240,31 +527,28 @@ func newValueStringFromTextMarshaler(x encoding.TextMarshaler) (*value, error) {
 	cStr := C.CString(string(s))
 	defer C.free(unsafe.Pointer(cStr))
 
-	return &value{cVal: C.mj_value_new_string(cStr)}, nil
+	return wrapValue(C.mj_value_new_string(cStr)), nil
 }
 
-func newValueStruct(x any) (*value, error) {
-	obj := &value{cVal: C.mj_value_new_object()}
-	rt := reflect.TypeOf(x)
+func (enc *encoder) newValueStruct(x any) (*value, error) {
+	obj := newValueObject()
 	rv := reflect.ValueOf(x)
 
-	for i := range rv.NumField() {
-		ft := rt.Field(i)
-		fv := rv.Field(i)
-
-		if !fv.CanInterface() {
+	for _, f := range cachedTypeFields(rv.Type(), enc.jsonTags) {
+		fv, ok := fieldValue(rv, f.index, false)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
 			continue
 		}
 
-		name := ft.Tag.Get(tagName)
-		if name == "-" {
-			continue
-		}
-		if name == "" {
-			name = ft.Name
+		var x any
+		if f.quoted {
+			x = quote(fv)
+		} else {
+			x = fv.Interface()
 		}
 
-		if err := obj.setKey(name, fv.Interface()); err != nil {
+		if err := enc.setKey(obj, f.name, x); err != nil {
+			_ = obj.Close()
 			return nil, err
 		}
 	}
@@ -284,9 +568,9 @@ func newValueUint(x uint) *value {
 }
 
 func newValueUint32(x uint32) *value {
-	return &value{cVal: C.mj_value_new_u32(C.uint32_t(x))}
+	return wrapValue(C.mj_value_new_u32(C.uint32_t(x)))
 }
 
 func newValueUint64(x uint64) *value {
-	return &value{cVal: C.mj_value_new_u64(C.uint64_t(x))}
+	return wrapValue(C.mj_value_new_u64(C.uint64_t(x)))
 }
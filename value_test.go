@@ -3,8 +3,12 @@ package minijinja_test
 import (
 	"errors"
 	"fmt"
+	"html/template"
+	"iter"
 	"math"
+	"math/big"
 	"reflect"
+	"slices"
 	"strconv"
 	"testing"
 
@@ -481,6 +485,153 @@ func TestValue_NumberUint64(t *testing.T) {
 	isEqual(t, in, out)
 }
 
+func TestValue_NumberSmallKinds(t *testing.T) {
+	t.Parallel()
+
+	var i8 int8
+	mustTestValue(t, math.MinInt8, &i8)
+	isEqual(t, math.MinInt8, i8)
+
+	var i16 int16
+	mustTestValue(t, math.MaxInt16, &i16)
+	isEqual(t, math.MaxInt16, i16)
+
+	var u8 uint8
+	mustTestValue(t, math.MaxUint8, &u8)
+	isEqual(t, math.MaxUint8, u8)
+
+	var u16 uint16
+	mustTestValue(t, math.MaxUint16, &u16)
+	isEqual(t, math.MaxUint16, u16)
+
+	var uptr uintptr
+	mustTestValue(t, 42, &uptr)
+	isEqual(t, 42, uptr)
+}
+
+func TestValue_NumberNamed(t *testing.T) {
+	t.Parallel()
+
+	type celsius float64
+	type count uint16
+
+	var outC celsius
+	mustTestValue(t, celsius(-12.5), &outC)
+	isEqual(t, -12.5, outC)
+
+	var outN count
+	mustTestValue(t, count(7), &outN)
+	isEqual(t, 7, outN)
+}
+
+func TestValue_NumberOverflow(t *testing.T) {
+	t.Parallel()
+
+	var out int8
+	err := testValue(t, 300, &out)
+	isTrue(t, err != nil)
+	mjErr := &minijinja.DecodeTypeError{}
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, "number 300", mjErr.Value)
+	isEqual(t, reflect.TypeFor[int8](), mjErr.Type)
+
+	var outU uint
+	err = testValue(t, -1, &outU)
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, "number -1", mjErr.Value)
+
+	var outF float32
+	err = testValue(t, math.MaxFloat64, &outF)
+	isTrue(t, errors.As(err, &mjErr))
+}
+
+func TestValue_NumberPrecisionLoss(t *testing.T) {
+	t.Parallel()
+
+	var out int
+	err := testValue(t, 1.5, &out)
+	isTrue(t, err != nil)
+	mjErr := &minijinja.DecodeTypeError{}
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, "number 1.5", mjErr.Value)
+
+	err = testValue(t, 2.0, &out)
+	noError(t, err)
+	isEqual(t, 2, out)
+
+	var outAny any
+	err = testValue(t, int64(1<<53+1), &outAny)
+	noError(t, err)
+	isEqual(t, any(int64(1<<53+1)), outAny)
+
+	err = testValue(t, uint64(math.MaxUint64), &outAny)
+	noError(t, err)
+	isEqual(t, any(uint64(math.MaxUint64)), outAny)
+
+	err = testValue(t, new(big.Int).Lsh(big.NewInt(1), 100), &outAny)
+	noError(t, err)
+	isEqual(t, any(math.Ldexp(1, 100)), outAny)
+
+	maxUint128 := new(big.Int).Sub(
+		new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1),
+	)
+	err = testValue(t, maxUint128, &outAny)
+	noError(t, err)
+	outBig, ok := outAny.(*big.Int)
+	isTrue(t, ok)
+	isEqual(t, 0, maxUint128.Cmp(outBig))
+
+	err = testValue(t, 1<<53, &outAny)
+	noError(t, err)
+	isEqual(t, any(float64(1<<53)), outAny)
+
+	var outFloat64 float64
+	err = testValue(t, int64(1<<53+1), &outFloat64)
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, "number 9007199254740993", mjErr.Value)
+
+	var outFloat float32
+	err = testValue(t, 1<<24+1, &outFloat)
+	isTrue(t, errors.As(err, &mjErr))
+
+	err = testValue(t, 0.1, &outFloat)
+	noError(t, err)
+	isEqual(t, float32(0.1), outFloat)
+}
+
+func TestValue_NumberBigInt(t *testing.T) {
+	t.Parallel()
+
+	maxUint128 := new(big.Int).Sub(
+		new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1),
+	)
+	minInt128 := new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 127))
+
+	for _, in := range []*big.Int{
+		big.NewInt(-42),
+		new(big.Int).Lsh(big.NewInt(1), 100),
+		maxUint128,
+		minInt128,
+	} {
+		var out *big.Int
+		err := testValue(t, in, &out)
+		noError(t, err)
+		isEqual(t, 0, in.Cmp(out))
+	}
+
+	var out big.Int
+	err := testValue(t, *big.NewInt(42), &out)
+	noError(t, err)
+	isEqual(t, int64(42), out.Int64())
+
+	tooBig := new(big.Int).Add(maxUint128, big.NewInt(1))
+	err = testValue(t, tooBig, &out)
+	isTrue(t, err != nil)
+	mjErr := &minijinja.UnsupportedValueError{}
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, tooBig.String(), mjErr.Str)
+}
+
 func TestValue_Map(t *testing.T) {
 	t.Parallel()
 
@@ -836,6 +987,167 @@ func TestValue_StringFromTextMarshalerWithUnmarshalError(t *testing.T) {
 	), mjErr.Error())
 }
 
+var errAMarshaler = errors.New("aMarshaler error")
+
+type aMarshaler struct {
+	amount   int64
+	currency string
+	fails    bool
+}
+
+func (m aMarshaler) MarshalMiniJinja() (any, error) {
+	if m.fails {
+		return nil, errAMarshaler
+	}
+	return map[string]any{"amount": m.amount, "currency": m.currency}, nil
+}
+
+func (m *aMarshaler) UnmarshalMiniJinja(unmarshal func(any) error) error {
+	var raw struct {
+		Amount   int64  `minijinja:"amount"`
+		Currency string `minijinja:"currency"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if raw.Currency == "" {
+		return errAMarshaler
+	}
+	m.amount, m.currency = raw.Amount, raw.Currency
+	return nil
+}
+
+func TestValue_Marshaler(t *testing.T) {
+	t.Parallel()
+
+	in := aMarshaler{amount: 1250, currency: "EUR"}
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	var s string
+	err := env.EvalExpr(
+		"price.amount ~ ' ' ~ price.currency",
+		map[string]any{"price": in}, &s,
+	)
+	noError(t, err)
+	isEqual(t, "1250 EUR", s)
+
+	var out aMarshaler
+	mustTestValue(t, in, &out)
+	isEqual(t, in, out)
+
+	var outPtr *aMarshaler
+	mustTestValue(t, &in, &outPtr)
+	isTrue(t, outPtr != nil)
+	isEqual(t, in, *outPtr)
+
+	var outNil *aMarshaler
+	mustTestValue(t, (*aMarshaler)(nil), &outNil)
+	isTrue(t, outNil == nil)
+}
+
+func TestValue_MarshalerWithMarshalError(t *testing.T) {
+	t.Parallel()
+
+	var out aMarshaler
+	err := testValue(t, aMarshaler{fails: true}, &out)
+	isTrue(t, err != nil)
+
+	mjErr := &minijinja.MarshalerError{}
+	isTrue(t, errors.As(err, &mjErr))
+	isTrue(t, errors.Is(mjErr.Unwrap(), errAMarshaler))
+	isEqual(t, reflect.TypeFor[aMarshaler](), mjErr.Type)
+	isEqual(t, fmt.Sprintf(
+		"minijinja: error calling MarshalMiniJinja for type %s: %s",
+		reflect.TypeFor[aMarshaler](),
+		errAMarshaler,
+	), mjErr.Error())
+}
+
+func TestValue_MarshalerWithUnmarshalError(t *testing.T) {
+	t.Parallel()
+
+	var out aMarshaler
+	err := testValue(t, map[string]any{"amount": 1}, &out)
+	isTrue(t, err != nil)
+
+	mjErr := &minijinja.UnmarshalerError{}
+	isTrue(t, errors.As(err, &mjErr))
+	isTrue(t, errors.Is(mjErr.Unwrap(), errAMarshaler))
+	isEqual(t, reflect.TypeFor[aMarshaler](), mjErr.Type)
+
+	err = testValue(t, "EUR", &out)
+	isTrue(t, err != nil)
+
+	decErr := &minijinja.DecodeTypeError{}
+	isTrue(t, errors.As(err, &decErr))
+}
+
+type aNonPointerUnmarshaler struct{}
+
+func (*aNonPointerUnmarshaler) UnmarshalMiniJinja(
+	unmarshal func(any) error,
+) error {
+	var s string
+	return unmarshal(s)
+}
+
+func TestValue_UnmarshalerNonPointer(t *testing.T) {
+	t.Parallel()
+
+	var out aNonPointerUnmarshaler
+	err := testValue(t, "EUR", &out)
+
+	mjErr := &minijinja.InvalidUnmarshalError{}
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, reflect.TypeFor[string](), mjErr.Type)
+	isEqual(t, "minijinja: unmarshal(non-pointer string)", mjErr.Error())
+}
+
+func TestValue_SafeString(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+	noError(t, env.SetAutoEscape(minijinja.AutoEscapeHTML))
+
+	res, err := env.RenderNamedString(
+		"safe", "{{ a }} {{ b }} {{ c }}", map[string]any{
+			"a": minijinja.SafeString("<p>a</p>"),
+			"b": template.HTML("<p>b</p>"),
+			"c": "<p>c</p>",
+		},
+	)
+	noError(t, err)
+	isEqual(t, "<p>a</p> <p>b</p> &lt;p&gt;c&lt;&#x2f;p&gt;", res)
+
+	expr := "{'a': a, 'b': '<b>'|safe, 'c': '<c>', '<d>'|safe: 'd'}"
+	vars := map[string]any{"a": minijinja.SafeString("<a>")}
+
+	var out map[any]any
+	err = env.EvalExprWithOptions(
+		expr, vars, &out, minijinja.EvalExprOptions{SafeStrings: true},
+	)
+	noError(t, err)
+	isEqual(t, any(minijinja.SafeString("<a>")), out["a"])
+	isEqual(t, any(minijinja.SafeString("<b>")), out["b"])
+	isEqual(t, any("<c>"), out["c"])
+	isEqual(t, any("d"), out["<d>"])
+
+	err = env.EvalExpr(expr, vars, &out)
+	noError(t, err)
+	isEqual(t, any("<a>"), out["a"])
+
+	var safe minijinja.SafeString
+	mustTestValue(t, minijinja.SafeString("<a>"), &safe)
+	isEqual(t, "<a>", safe)
+
+	var html template.HTML
+	mustTestValue(t, template.HTML("<a>"), &html)
+	isEqual(t, "<a>", html)
+}
+
 func TestValue_StringInterface(t *testing.T) {
 	t.Parallel()
 
@@ -1041,6 +1353,214 @@ func TestValue_Struct(t *testing.T) {
 	isEqual(t, in.ID, out.ID)
 }
 
+func TestValue_StructJSONTags(t *testing.T) {
+	t.Parallel()
+
+	type thisStruct struct {
+		Name    string `json:"name"`
+		ID      int    `json:"id" minijinja:"ident"`
+		Ignored string `json:"-"`
+		Other   string
+	}
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+	env.SetJSONTags(true)
+
+	in := thisStruct{Name: "Go", ID: 123, Ignored: "x", Other: "y"}
+
+	var keys []string
+	err := env.EvalExpr("value|list|sort", map[string]any{"value": in}, &keys)
+	noError(t, err)
+	isEqual(t, "[Other ident name]", fmt.Sprint(keys))
+
+	var out thisStruct
+	err = env.EvalExpr("value", map[string]any{"value": in}, &out)
+	noError(t, err)
+	isEqual(t, in.Name, out.Name)
+	isEqual(t, in.ID, out.ID)
+	isEqual(t, "", out.Ignored)
+	isEqual(t, in.Other, out.Other)
+
+	val, err := minijinja.ValueOf(in, minijinja.WithJSONTags())
+	noError(t, err)
+	defer val.Close()
+
+	var name string
+	err = env.EvalExpr("value.name", map[string]any{"value": val}, &name)
+	noError(t, err)
+	isEqual(t, in.Name, name)
+}
+
+func TestValue_StructOmitEmpty(t *testing.T) {
+	t.Parallel()
+
+	type thisStruct struct {
+		Name  string         `minijinja:"name,omitempty"`
+		Seq   []any          `minijinja:"seq,omitempty"`
+		Map   map[string]int `minijinja:"map,omitempty"`
+		Ptr   *int           `minijinja:"ptr,omitempty"`
+		Count int            `minijinja:"count,omitempty"`
+		Kept  int            `minijinja:"kept"`
+	}
+
+	var keys []string
+	err := testValue(t, thisStruct{}, &keys)
+	noError(t, err)
+	isEqual(t, "[kept]", fmt.Sprint(keys))
+
+	err = testValue(t, thisStruct{Name: "Go", Count: 1}, &keys)
+	noError(t, err)
+	isEqual(t, 3, len(keys))
+}
+
+func TestValue_StructInline(t *testing.T) {
+	t.Parallel()
+
+	type meta struct {
+		Author string `minijinja:"author"`
+	}
+	type extra struct {
+		Editor string `minijinja:"editor"`
+	}
+	type thisStruct struct {
+		Title string `minijinja:"title"`
+		Meta  meta   `minijinja:",inline"`
+		Extra *extra `minijinja:"extra,inline"`
+	}
+
+	in := thisStruct{
+		Title: "Go",
+		Meta:  meta{Author: "Gopher"},
+		Extra: &extra{Editor: "Ferris"},
+	}
+
+	var outMap map[string]string
+	err := testValue(t, in, &outMap)
+	noError(t, err)
+	isEqual(t, 3, len(outMap))
+	isEqual(t, "Gopher", outMap["author"])
+	isEqual(t, "Ferris", outMap["editor"])
+
+	var out thisStruct
+	err = testValue(t, in, &out)
+	noError(t, err)
+	isEqual(t, in, out)
+
+	err = testValue(t, thisStruct{Title: "Go"}, &outMap)
+	noError(t, err)
+	isEqual(t, 2, len(outMap))
+}
+
+func TestValue_StructEmbedded(t *testing.T) {
+	t.Parallel()
+
+	type Base struct {
+		ID   int
+		Name string
+	}
+	type meta struct {
+		Author string
+	}
+	type thisStruct struct {
+		Base
+		*meta
+		Name string
+	}
+
+	in := thisStruct{
+		Base: Base{ID: 1, Name: "base"},
+		meta: &meta{Author: "Gopher"},
+		Name: "outer",
+	}
+
+	var outMap map[string]any
+	err := testValue(t, in, &outMap)
+	noError(t, err)
+	isEqual(t, "map[Author:Gopher ID:1 Name:outer]", fmt.Sprint(outMap))
+
+	var out thisStruct
+	err = testValue(t, map[string]any{"ID": 2, "Name": "outer"}, &out)
+	noError(t, err)
+	isEqual(t, 2, out.ID)
+	isEqual(t, "outer", out.Name)
+	isEqual(t, "", out.Base.Name)
+
+	err = testValue(t, map[string]any{"Author": "Gopher"}, &out)
+	isTrue(t, errors.Is(err, minijinja.ErrUnexportedEmbeddedPointer))
+}
+
+func TestValue_StructEmbeddedAmbiguous(t *testing.T) {
+	t.Parallel()
+
+	type A struct {
+		Name string
+		X    int
+	}
+	type B struct {
+		Name string
+		Y    int `minijinja:"X"`
+	}
+	type C struct {
+		Name string
+	}
+	type D struct {
+		C
+	}
+	type thisStruct struct {
+		A
+		B
+		D
+	}
+
+	in := thisStruct{
+		A: A{Name: "a", X: 1},
+		B: B{Name: "b", Y: 2},
+		D: D{C: C{Name: "c"}},
+	}
+
+	var outMap map[string]any
+	err := testValue(t, in, &outMap)
+	noError(t, err)
+	isEqual(t, "map[X:2]", fmt.Sprint(outMap))
+
+	var out thisStruct
+	err = testValue(t, map[string]any{"Name": "x", "X": 3}, &out)
+	noError(t, err)
+	isEqual(t, thisStruct{B: B{Y: 3}}, out)
+}
+
+func TestValue_StructString(t *testing.T) {
+	t.Parallel()
+
+	type thisStruct struct {
+		ID    int64   `minijinja:"id,string"`
+		Ratio float64 `minijinja:"ratio,string"`
+		On    bool    `minijinja:"on,string"`
+	}
+
+	in := thisStruct{ID: 9007199254740993, Ratio: 0.5, On: true}
+
+	var outMap map[string]any
+	err := testValue(t, in, &outMap)
+	noError(t, err)
+	isEqual(t, any("9007199254740993"), outMap["id"])
+	isEqual(t, any("0.5"), outMap["ratio"])
+	isEqual(t, any("true"), outMap["on"])
+
+	var out thisStruct
+	err = testValue(t, in, &out)
+	noError(t, err)
+	isEqual(t, in, out)
+
+	err = testValue(t, map[string]string{"id": "abc"}, &out)
+	isTrue(t, err != nil)
+	mjErr := &minijinja.DecodeTypeError{}
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, `string "abc"`, mjErr.Value)
+	isEqual(t, reflect.TypeFor[int64](), mjErr.Type)
+}
+
 func TestValue_NotMap(t *testing.T) {
 	t.Parallel()
 
@@ -1132,3 +1652,208 @@ func TestValue_NotStruct(t *testing.T) {
 	isEqual(t, "number "+strconv.Itoa(in), mjErr.Value)
 	isEqual(t, reflect.TypeFor[struct{}](), mjErr.Type)
 }
+
+func TestValueOf(t *testing.T) {
+	t.Parallel()
+
+	val, err := minijinja.ValueOf(map[string]any{"x": 1, "seq": []int{1, 2}})
+	noError(t, err)
+	defer val.Close()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	err = env.AddGlobal("site", "Go")
+	noError(t, err)
+
+	for range 2 {
+		s, err := env.RenderNamedString(
+			"hello", "{{ site }} {{ x }} {{ seq }}", val,
+		)
+		noError(t, err)
+		isEqual(t, "Go 1 [1, 2]", s)
+	}
+
+	var out map[string]any
+	err = testValue(t, val, &out)
+	noError(t, err)
+	isEqual(t, 2, len(out))
+	isEqual(t, 1.0, out["x"])
+
+	env2 := minijinja.NewEnvironment()
+	defer env2.Close()
+
+	var defined bool
+	err = env2.EvalExpr("site is defined", val, &defined)
+	noError(t, err)
+	isTrue(t, !defined)
+}
+
+type aValueMarshaler struct {
+	val minijinja.Value
+}
+
+func (m aValueMarshaler) MarshalMiniJinja() (any, error) {
+	return m.val, nil
+}
+
+func TestValueOfMarshaler(t *testing.T) {
+	t.Parallel()
+
+	val, err := minijinja.ValueOf(map[string]any{"x": 1})
+	noError(t, err)
+	defer val.Close()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	noError(t, env.AddGlobal("site", "Go"))
+
+	s, err := env.RenderNamedString(
+		"hello", "{{ site }} {{ x }}", aValueMarshaler{val: val},
+	)
+	noError(t, err)
+	isEqual(t, "Go 1", s)
+
+	env2 := minijinja.NewEnvironment()
+	defer env2.Close()
+
+	var defined bool
+	err = env2.EvalExpr("site is defined", val, &defined)
+	noError(t, err)
+	isTrue(t, !defined)
+}
+
+func TestValueOfClosed(t *testing.T) {
+	t.Parallel()
+
+	val, err := minijinja.ValueOf("hello")
+	noError(t, err)
+	noError(t, val.Close())
+	noError(t, val.Close())
+
+	var out string
+	err = testValue(t, val, &out)
+	isTrue(t, errors.Is(err, minijinja.ErrClosedValue))
+}
+
+func TestValueOfZero(t *testing.T) {
+	t.Parallel()
+
+	var out any
+	err := testValue(t, minijinja.Value{}, &out)
+	noError(t, err)
+	isEqual(t, nil, out)
+}
+
+func TestValue_LiveHandles(t *testing.T) {
+	before := minijinja.LiveHandles()
+
+	func() {
+		env := minijinja.NewEnvironment()
+		defer env.Close()
+
+		noError(t, env.AddGlobal("site", map[string]string{"name": "Go"}))
+		noError(t, env.AddGlobal("site", map[string]string{"name": "Go!"}))
+
+		shared, err := minijinja.ValueOf(map[string]any{"seq": []int{1, 2}})
+		noError(t, err)
+		defer shared.Close()
+
+		ctx := struct {
+			Name   string            `minijinja:"name"`
+			Seq    []any             `minijinja:"seq"`
+			Map    map[string]string `minijinja:"map"`
+			Shared minijinja.Value   `minijinja:"shared"`
+		}{
+			Name:   "Go",
+			Seq:    []any{"First", 42, []byte("bytes")},
+			Map:    map[string]string{"key": "value"},
+			Shared: shared,
+		}
+
+		_, err = env.RenderNamedString("hello", "{{ name }} {{ seq }}", ctx)
+		noError(t, err)
+		_, err = env.RenderNamedString("hello", "{{ seq }}", shared)
+		noError(t, err)
+		_, err = env.RenderTemplate("missing", ctx)
+		isTrue(t, err != nil)
+		_, err = env.RenderNamedString("hello", "{{ x }}", map[string]any{
+			"x": []any{1, func() {}},
+		})
+		isTrue(t, err != nil)
+
+		var out struct {
+			Name   string            `minijinja:"name"`
+			Seq    []any             `minijinja:"seq"`
+			Map    map[string]string `minijinja:"map"`
+			Shared map[string][2]int `minijinja:"shared"`
+		}
+		noError(t, env.EvalExpr("ctx", map[string]any{"ctx": ctx}, &out))
+		isEqual(t, 2, out.Shared["seq"][1])
+
+		var outAny any
+		noError(t, env.EvalExpr("ctx", map[string]any{"ctx": ctx}, &outAny))
+	}()
+
+	isEqual(t, before, minijinja.LiveHandles())
+}
+
+func TestValue_IterSeq(t *testing.T) {
+	t.Parallel()
+
+	var out []string
+	err := testValue(t, slices.Values([]string{"a", "b", "c"}), &out)
+	noError(t, err)
+	isEqual(t, 3, len(out))
+	isEqual(t, "c", out[2])
+
+	var seq iter.Seq[int]
+	var outAny any = "not-nil"
+	err = testValue(t, seq, &outAny)
+	noError(t, err)
+	isEqual(t, "not-nil", outAny)
+}
+
+func TestValue_IterSeq2(t *testing.T) {
+	t.Parallel()
+
+	env := minijinja.NewEnvironment()
+	defer env.Close()
+
+	s, err := env.RenderNamedString(
+		"hello",
+		"{% for i, x in seq %}{{ i }}={{ x }};{% endfor %}",
+		map[string]any{"seq": slices.All([]string{"a", "b"})},
+	)
+	noError(t, err)
+	isEqual(t, "0=a;1=b;", s)
+}
+
+func TestValue_IterSeqUnsupported(t *testing.T) {
+	t.Parallel()
+
+	var out []any
+	err := testValue(t, slices.Values([]any{1, func() {}}), &out)
+	isTrue(t, err != nil)
+
+	mjErr := &minijinja.UnsupportedTypeError{}
+	isTrue(t, errors.As(err, &mjErr))
+	isEqual(t, reflect.TypeFor[func()](), mjErr.Type)
+}
+
+func TestValue_Chan(t *testing.T) {
+	t.Parallel()
+
+	in := make(chan int, 3)
+	in <- 1
+	in <- 2
+	in <- 3
+	close(in)
+
+	var out []int
+	err := testValue(t, (<-chan int)(in), &out)
+	noError(t, err)
+	isEqual(t, 3, len(out))
+	isEqual(t, 3, out[2])
+}